@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const adsBlocklist = `
+[[blocklist]]
+name = "ads"
+entries = ["ads.example.net"]
+`
+
+func TestBlockingResponses(t *testing.T) {
+	for _, test := range []struct {
+		settings string
+		rcode    int
+		a        string
+		aaaa     string
+	}{
+		{"", dns.RcodeNameError, "", ""},
+		{"response = \"nxdomain\"", dns.RcodeNameError, "", ""},
+		{"response = \"refuse\"", dns.RcodeRefused, "", ""},
+		{"response = \"null\"", dns.RcodeSuccess, "0.0.0.0", "::"},
+		{"response = \"sinkhole\"\nsinkholeipv4 = \"192.0.2.250\"\nsinkholeipv6 = \"2001:db8::250\"", dns.RcodeSuccess, "192.0.2.250", "2001:db8::250"},
+	} {
+		recursor := &testRecursor{address: "192.0.2.10"}
+		app := newTestApp(t, "[settings.blocking]\n"+test.settings+"\nttl = 30\n"+adsBlocklist, recursor)
+		for qtype, expected := range map[uint16]string{dns.TypeA: test.a, dns.TypeAAAA: test.aaaa, dns.TypeMX: ""} {
+			r := query("banner.ads.example.net.", qtype)
+			r.SetEdns0(1232, false)
+			response := ask(app, context.Background(), newTestWriter("udp"), "127.0.0.1:5353", r)
+			if response.Rcode != test.rcode {
+				t.Errorf("%s, %s: expected %s, got %s", test.settings, dns.TypeToString[qtype], dns.RcodeToString[test.rcode], dns.RcodeToString[response.Rcode])
+			}
+			got := ""
+			if len(response.Answer) == 1 {
+				switch rr := response.Answer[0].(type) {
+				case *dns.A:
+					got = rr.A.String()
+				case *dns.AAAA:
+					got = rr.AAAA.String()
+				}
+				if response.Answer[0].Header().Ttl != 30 {
+					t.Errorf("%s, %s: expected a TTL of 30, got %d", test.settings, dns.TypeToString[qtype], response.Answer[0].Header().Ttl)
+				}
+			}
+			if got != expected || len(response.Answer) > 1 || expected == "" && len(response.Answer) > 0 {
+				t.Errorf("%s, %s: expected '%s', got %v", test.settings, dns.TypeToString[qtype], expected, response.Answer)
+			}
+			errors := extendedErrors(response)
+			if len(errors) != 1 || errors[0].InfoCode != dns.ExtendedErrorCodeBlocked || errors[0].ExtraText != "ads (ads.example.net)" {
+				t.Errorf("%s, %s: expected the reason to be given, got %v", test.settings, dns.TypeToString[qtype], errors)
+			}
+		}
+		if recursor.calls != 0 {
+			t.Errorf("%s: expected nothing to be looked up", test.settings)
+		}
+	}
+}
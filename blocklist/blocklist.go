@@ -0,0 +1,237 @@
+// Package blocklist tells which names should not be resolved, from hosts
+// files, AdBlock filters and plain domain lists, as found in the wild.
+package blocklist
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/fusion/kittendns/config"
+	"github.com/fusion/kittendns/lists"
+)
+
+// Names a hosts file maps to the local host, which are not ads.
+var localNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+type source struct {
+	sync.RWMutex
+	definition config.Blocklist
+	blocked    *lists.Domains
+	// Exceptions: from an allowlist, or AdBlock's "@@||domain^"
+	allowed *lists.Domains
+	size    int
+}
+
+// Blocklist checks names against all of its sources. Allowed domains always
+// win.
+type Blocklist struct {
+	sources []*source
+	watcher *fsnotify.Watcher
+}
+
+// New reads the sources. They do not follow changes to their files until
+// Watch is called.
+func New(definitions []config.Blocklist) (*Blocklist, error) {
+	blocklist := &Blocklist{}
+	for _, definition := range definitions {
+		source := &source{definition: definition}
+		if err := source.load(); err != nil {
+			return nil, fmt.Errorf("blocklist %s: %s", definition.Name, err)
+		}
+		blocklist.sources = append(blocklist.sources, source)
+	}
+	return blocklist, nil
+}
+
+// Check tells whether name is blocked and, if so, why.
+func (b *Blocklist) Check(name string) (string, bool) {
+	if b == nil {
+		return "", false
+	}
+	for _, source := range b.sources {
+		if source.allows(name) {
+			return "", false
+		}
+	}
+	for _, source := range b.sources {
+		if reason, ok := source.blocks(name); ok {
+			return reason, true
+		}
+	}
+	return "", false
+}
+
+// Len is the number of domains blocked, and allowed, by all sources.
+func (b *Blocklist) Len() int {
+	size := 0
+	for _, source := range b.sources {
+		source.RLock()
+		size += source.size
+		source.RUnlock()
+	}
+	return size
+}
+
+func (s *source) allows(name string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.allowed.Contains(name)
+}
+
+func (s *source) blocks(name string) (string, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	domain, ok := s.blocked.Match(name)
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("%s (%s)", s.definition.Name, domain), true
+}
+
+// load (re)reads the source, which is left as it was if its file cannot be
+// read. Lines that make no sense are skipped: lists found in the wild are
+// seldom clean.
+func (s *source) load() error {
+	blocked := &lists.Domains{}
+	allowed := &lists.Domains{}
+	size, skipped := 0, 0
+	add := func(line string) error {
+		domains, allow, ok := parseLine(line)
+		if !ok {
+			skipped++
+			return nil
+		}
+		for _, domain := range domains {
+			if allow || s.definition.Allow {
+				allowed.Add(domain)
+			} else {
+				blocked.Add(domain)
+			}
+			size++
+		}
+		return nil
+	}
+	for _, entry := range s.definition.Entries {
+		add(entry)
+	}
+	if s.definition.File != "" {
+		if err := lists.ReadEntries(s.definition.File, add); err != nil {
+			return err
+		}
+	}
+	if skipped > 0 {
+		log.Printf("Blocklist %s: skipped %d entries.\n", s.definition.Name, skipped)
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.blocked = blocked
+	s.allowed = allowed
+	s.size = size
+	return nil
+}
+
+// parseLine finds the domains a hosts, AdBlock or domain list line is about.
+// Comments are gone already. allow is set for AdBlock exceptions.
+func parseLine(line string) (domains []string, allow bool, ok bool) {
+	switch {
+	case strings.HasPrefix(line, "!"), strings.HasPrefix(line, "["):
+		// AdBlock comment, or header
+		return nil, false, true
+	case strings.HasPrefix(line, "@@||"):
+		domain, ok := parseAdBlock(line[4:])
+		return []string{domain}, true, ok
+	case strings.HasPrefix(line, "||"):
+		domain, ok := parseAdBlock(line[2:])
+		return []string{domain}, false, ok
+	}
+	fields := strings.Fields(line)
+	if len(fields) >= 2 && net.ParseIP(fields[0]) != nil {
+		// Hosts file
+		fields = fields[1:]
+	} else if len(fields) == 1 {
+		fields[0] = strings.TrimPrefix(strings.TrimPrefix(fields[0], "*"), ".")
+	} else {
+		return nil, false, false
+	}
+	for _, domain := range fields {
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		if localNames[domain] {
+			continue
+		}
+		if !lists.ValidDomain(domain) {
+			return nil, false, false
+		}
+		domains = append(domains, domain)
+	}
+	return domains, false, true
+}
+
+// parseAdBlock accepts the basic "domain^" rules, with or without options,
+// which are what DNS blocking can honour.
+func parseAdBlock(rule string) (string, bool) {
+	if idx := strings.IndexByte(rule, '$'); idx >= 0 {
+		rule = rule[:idx]
+	}
+	if !strings.HasSuffix(rule, "^") {
+		return "", false
+	}
+	domain := strings.ToLower(strings.TrimSuffix(rule, "^"))
+	if !lists.ValidDomain(domain) {
+		return "", false
+	}
+	return domain, true
+}
+
+// Watch re-reads sources whenever their file changes, until Close is called.
+func (b *Blocklist) Watch() error {
+	byPath := map[string][]*source{}
+	var paths []string
+	for _, source := range b.sources {
+		if source.definition.File != "" {
+			path := filepath.Clean(source.definition.File)
+			if _, ok := byPath[path]; !ok {
+				paths = append(paths, path)
+			}
+			byPath[path] = append(byPath[path], source)
+		}
+	}
+	watcher, err := lists.WatchFiles(paths, func(path string) {
+		for _, source := range byPath[path] {
+			if err := source.load(); err != nil {
+				log.Printf("Warning: unable to reload blocklist %s: %s\n", source.definition.Name, err)
+				continue
+			}
+			log.Printf("Blocklist %s reloaded.\n", source.definition.Name)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	b.watcher = watcher
+	return nil
+}
+
+// Close stops following changes to files.
+func (b *Blocklist) Close() {
+	if b.watcher != nil {
+		b.watcher.Close()
+	}
+}
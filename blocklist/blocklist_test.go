@@ -0,0 +1,89 @@
+package blocklist
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fusion/kittendns/config"
+)
+
+func TestFormats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mixed.txt")
+	content := `# Hosts
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.com # two at once
+! AdBlock
+[Adblock Plus 2.0]
+||doubleclick.net^
+||metrics.example.org^$third-party
+@@||good.doubleclick.net^
+example.*##.banner
+example.com##.banner
+example.com#@#.sponsored
+example.com#?#div:-abp-has(.ad)
+adserver.example.net # comment, after a space
+# Domains
+*.malware.test
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	blocklist, err := New([]config.Blocklist{
+		{Name: "mixed", File: path},
+		{Name: "mine", Allow: true, Entries: []string{"safe.malware.test"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"ads.example.com.":       "mixed (ads.example.com)",
+		"x.tracker.example.com.": "mixed (tracker.example.com)",
+		"example.com.":           "",
+		"localhost.":             "",
+		"ad.doubleclick.net.":    "mixed (doubleclick.net)",
+		"good.doubleclick.net.":  "",
+		"metrics.example.org.":   "mixed (metrics.example.org)",
+		"adserver.example.net.":  "mixed (adserver.example.net)",
+		"malware.test.":          "mixed (malware.test)",
+		"safe.malware.test.":     "",
+		"www.safe.malware.test.": "",
+	} {
+		reason, blocked := blocklist.Check(name)
+		if blocked != (expected != "") || reason != expected {
+			t.Errorf("Expected %s to be blocked for '%s', got %v, '%s'", name, expected, blocked, reason)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte("0.0.0.0 ads.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	blocklist, err := New([]config.Blocklist{{Name: "hosts", File: path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blocklist.Watch(); err != nil {
+		t.Fatal(err)
+	}
+	defer blocklist.Close()
+	if _, blocked := blocklist.Check("ads.example.com."); !blocked {
+		t.Fatal("Expected ads.example.com to be blocked")
+	}
+	if err := os.WriteFile(path, []byte("0.0.0.0 tracker.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, blocked := blocklist.Check("tracker.example.com."); !blocked; _, blocked = blocklist.Check("tracker.example.com.") {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the blocklist to be reloaded")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if _, blocked := blocklist.Check("ads.example.com."); blocked {
+		t.Error("Expected removed entries to be forgotten")
+	}
+}
@@ -1,6 +1,12 @@
 package cache
 
 import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -9,25 +15,112 @@ import (
 type RcCacheEntry struct {
 	Type     uint16
 	ExpireTS int64
+	Rcode    int
 	Targets  []dns.RR
+	Ns       []dns.RR
+	Extra    []dns.RR
+	// EDNS Client Subnet scope the answer is valid for, 0 meaning everyone.
+	ScopePrefix uint8
 }
 
 type RcCache struct {
+	sync.RWMutex
 	Entries map[string]RcCacheEntry
 	BackRef map[string]string
+	// For each name and type, the network masks answers were scoped to.
+	Scopes map[string][]net.IPMask
+	// How long expired entries are kept around, in case our parents fail us.
+	MaxStale time.Duration
+	swept    int64
 }
 
-func (c *RcCache) Get(name string) ([]dns.RR, bool, uint32) {
-	if entry, ok := c.Entries[name]; ok {
-		remaining := uint32(entry.ExpireTS - time.Now().Unix())
+// Seconds between two sweeps of the entries nobody asked for again.
+const sweepInterval = 60
+
+// Entries are keyed by name and type: an A answer has nothing to do with an
+// AAAA answer for the same name.
+func key(name string, dnsType uint16) string {
+	return fmt.Sprintf("%s/%d", name, dnsType)
+}
+
+// Answers scoped to a client network are only valid for that network.
+func scopedKey(name string, dnsType uint16, scope *net.IPNet) string {
+	return fmt.Sprintf("%s@%s", key(name, dnsType), scope.String())
+}
+
+// Get returns the cached response for name, with its records' TTL lowered to
+// the number of seconds the entry has left to live. Answers scoped to the
+// client's network are preferred to the ones valid for everyone.
+func (c *RcCache) Get(name string, dnsType uint16, client net.IP) (*RcCacheEntry, bool, uint32) {
+	now := time.Now().Unix()
+	c.RLock()
+	entryKey, entry, ok := c.lookup(name, dnsType, client, now)
+	c.RUnlock()
+	if ok {
+		remaining := entry.ExpireTS - now
 		if remaining > 0 {
-			return entry.Targets, true, remaining
+			return withTTL(entry, uint32(remaining)), true, uint32(remaining)
+		}
+		if now-entry.ExpireTS > int64(c.MaxStale.Seconds()) {
+			c.Lock()
+			delete(c.Entries, entryKey)
+			c.Unlock()
 		}
-		delete(c.Entries, name)
 	}
 	return nil, false, 0
 }
 
+// Records served stale are given this TTL (RFC 8767)
+const StaleTTL = 30
+
+// GetStale returns a cached response for name that expired no longer than
+// MaxStale ago, for when it cannot be refreshed.
+func (c *RcCache) GetStale(name string, dnsType uint16, client net.IP) (*RcCacheEntry, bool) {
+	now := time.Now().Unix()
+	c.RLock()
+	_, entry, ok := c.lookup(name, dnsType, client, now-int64(c.MaxStale.Seconds()))
+	c.RUnlock()
+	if !ok || c.MaxStale == 0 || now-entry.ExpireTS > int64(c.MaxStale.Seconds()) {
+		return nil, false
+	}
+	return withTTL(entry, StaleTTL), true
+}
+
+// lookup finds the entry for name, preferring the ones scoped to the client's
+// network that expire after notBefore.
+func (c *RcCache) lookup(name string, dnsType uint16, client net.IP, notBefore int64) (string, RcCacheEntry, bool) {
+	entryKey := key(name, dnsType)
+	if client != nil {
+		if client4 := client.To4(); client4 != nil {
+			client = client4
+		}
+		for _, mask := range c.Scopes[entryKey] {
+			if len(mask) != len(client) {
+				continue
+			}
+			candidate := scopedKey(name, dnsType, &net.IPNet{IP: client.Mask(mask), Mask: mask})
+			if entry, ok := c.Entries[candidate]; ok && entry.ExpireTS > notBefore {
+				return candidate, entry, true
+			}
+		}
+	}
+	entry, ok := c.Entries[entryKey]
+	return entryKey, entry, ok
+}
+
+func withTTL(entry RcCacheEntry, ttl uint32) *RcCacheEntry {
+	entry.Targets = withRemainingTTL(entry.Targets, ttl)
+	entry.Ns = withRemainingTTL(entry.Ns, ttl)
+	entry.Extra = withRemainingTTL(entry.Extra, ttl)
+	return &entry
+}
+
+func (c *RcCache) Len() int {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.Entries)
+}
+
 type MaybeFlatten int
 
 const (
@@ -35,7 +128,12 @@ const (
 	DoNotFlatten
 )
 
-func (c *RcCache) Set(flatten MaybeFlatten, name string, dnsType uint16, targets []dns.RR, ttl uint32) {
+// Set caches response, answers and errors alike, for ttl seconds. If scope
+// is set, the response is only valid for clients from that network.
+func (c *RcCache) Set(flatten MaybeFlatten, name string, dnsType uint16, response *dns.Msg, ttl uint32, scope *net.IPNet) {
+	c.Lock()
+	defer c.Unlock()
+
 	if c.Entries == nil {
 		c.Entries = make(map[string]RcCacheEntry)
 	}
@@ -43,14 +141,28 @@ func (c *RcCache) Set(flatten MaybeFlatten, name string, dnsType uint16, targets
 		c.BackRef = make(map[string]string)
 	}
 
-	expireTs := time.Now().Unix() + int64(ttl)
+	now := time.Now().Unix()
+	c.sweep(now)
+	expireTs := now + int64(ttl)
+	targets := response.Answer
 
-	c.Entries[name] = RcCacheEntry{
+	entry := RcCacheEntry{
 		Type:     dnsType,
 		ExpireTS: expireTs,
+		Rcode:    response.Rcode,
 		Targets:  targets,
+		Ns:       response.Ns,
+		Extra:    response.Extra,
 	}
-	if flatten == Flatten {
+	if scope != nil {
+		ones, _ := scope.Mask.Size()
+		entry.ScopePrefix = uint8(ones)
+		c.Entries[scopedKey(name, dnsType, scope)] = entry
+		c.addScope(key(name, dnsType), scope.Mask)
+		return
+	}
+	c.Entries[key(name, dnsType)] = entry
+	if flatten == Flatten && response.Rcode == dns.RcodeSuccess {
 		switch dnsType {
 		case dns.TypeCNAME:
 			if len(targets) > 0 {
@@ -62,8 +174,8 @@ func (c *RcCache) Set(flatten MaybeFlatten, name string, dnsType uint16, targets
 				if !ok {
 					break
 				}
-				backRefEntry := c.Entries[backRefName]
-				c.Entries[backRefName] = RcCacheEntry{
+				backRefEntry := c.Entries[key(backRefName, dns.TypeCNAME)]
+				c.Entries[key(backRefName, dns.TypeA)] = RcCacheEntry{
 					Type:     dns.TypeA,
 					ExpireTS: backRefEntry.ExpireTS,
 					Targets:  targets,
@@ -74,4 +186,184 @@ func (c *RcCache) Set(flatten MaybeFlatten, name string, dnsType uint16, targets
 	}
 }
 
-// TODO Create ageing function that will clean up both entries and backrefs
+// sweep forgets the entries that are too old to be served, even stale, along
+// with the scopes and back references that led to them. Names that are never
+// asked for again would otherwise stay forever.
+func (c *RcCache) sweep(now int64) {
+	if now-c.swept < sweepInterval {
+		return
+	}
+	c.swept = now
+	maxStale := int64(c.MaxStale.Seconds())
+	c.Scopes = nil
+	for entryKey, entry := range c.Entries {
+		if now-entry.ExpireTS > maxStale {
+			delete(c.Entries, entryKey)
+			continue
+		}
+		if at := strings.LastIndex(entryKey, "@"); at > 0 {
+			if _, scope, err := net.ParseCIDR(entryKey[at+1:]); err == nil {
+				c.addScope(entryKey[:at], scope.Mask)
+			}
+		}
+	}
+	for target, name := range c.BackRef {
+		if _, ok := c.Entries[key(name, dns.TypeCNAME)]; !ok {
+			delete(c.BackRef, target)
+		}
+	}
+}
+
+func (c *RcCache) addScope(entryKey string, mask net.IPMask) {
+	if c.Scopes == nil {
+		c.Scopes = make(map[string][]net.IPMask)
+	}
+	for _, known := range c.Scopes[entryKey] {
+		if known.String() == mask.String() {
+			return
+		}
+	}
+	c.Scopes[entryKey] = append(c.Scopes[entryKey], mask)
+}
+
+// On disk, records are kept in their presentation format.
+type savedEntry struct {
+	Type     uint16
+	ExpireTS int64
+	Rcode    int
+	Targets  []string
+	Ns       []string
+	Extra    []string
+	// Not saved: stale scopes just cost an extra lookup.
+	ScopePrefix uint8
+}
+
+type savedCache struct {
+	Entries map[string]savedEntry
+	BackRef map[string]string
+}
+
+// Save dumps every live entry to path, so that a later Load can pick up
+// where we left off.
+func (c *RcCache) Save(path string) error {
+	c.RLock()
+	now := time.Now().Unix()
+	saved := savedCache{
+		Entries: make(map[string]savedEntry, len(c.Entries)),
+		BackRef: make(map[string]string, len(c.BackRef)),
+	}
+	for name, entry := range c.Entries {
+		if entry.ExpireTS <= now {
+			continue
+		}
+		saved.Entries[name] = savedEntry{
+			Type:     entry.Type,
+			ExpireTS: entry.ExpireTS,
+			Rcode:    entry.Rcode,
+			Targets:  toText(entry.Targets),
+			Ns:       toText(entry.Ns),
+			Extra:    toText(entry.Extra),
+
+			ScopePrefix: entry.ScopePrefix,
+		}
+	}
+	for target, name := range c.BackRef {
+		saved.BackRef[target] = name
+	}
+	c.RUnlock()
+
+	raw, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	// Write next to the destination, then swap, so that a crash never leaves
+	// a truncated dump behind.
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Load restores the entries previously written by Save. Entries that expired
+// in the meantime are skipped; the others keep their original expiry time.
+func (c *RcCache) Load(path string) (int, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var saved savedCache
+	if err := json.Unmarshal(raw, &saved); err != nil {
+		return 0, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.Entries == nil {
+		c.Entries = make(map[string]RcCacheEntry)
+	}
+	if c.BackRef == nil {
+		c.BackRef = make(map[string]string)
+	}
+
+	now := time.Now().Unix()
+	restored := 0
+	for name, entry := range saved.Entries {
+		if entry.ExpireTS <= now {
+			continue
+		}
+		c.Entries[name] = RcCacheEntry{
+			Type:     entry.Type,
+			ExpireTS: entry.ExpireTS,
+			Rcode:    entry.Rcode,
+			Targets:  fromText(entry.Targets),
+			Ns:       fromText(entry.Ns),
+			Extra:    fromText(entry.Extra),
+
+			ScopePrefix: entry.ScopePrefix,
+		}
+		if at := strings.LastIndex(name, "@"); at > 0 {
+			if _, scope, err := net.ParseCIDR(name[at+1:]); err == nil {
+				c.addScope(name[:at], scope.Mask)
+			}
+		}
+		restored++
+	}
+	for target, name := range saved.BackRef {
+		c.BackRef[target] = name
+	}
+	return restored, nil
+}
+
+func toText(rrs []dns.RR) []string {
+	texts := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		texts = append(texts, rr.String())
+	}
+	return texts
+}
+
+func fromText(texts []string) []dns.RR {
+	rrs := make([]dns.RR, 0, len(texts))
+	for _, text := range texts {
+		rr, err := dns.NewRR(text)
+		if err != nil || rr == nil {
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+func withRemainingTTL(targets []dns.RR, remaining uint32) []dns.RR {
+	rrs := make([]dns.RR, 0, len(targets))
+	for _, rr := range targets {
+		rr = dns.Copy(rr)
+		if rr.Header().Ttl > remaining {
+			rr.Header().Ttl = remaining
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
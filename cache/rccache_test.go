@@ -0,0 +1,156 @@
+package cache
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSaveAndLoad(t *testing.T) {
+	rr, _ := dns.NewRR("example.com. 300 IN A 1.2.3.4")
+	expired, _ := dns.NewRR("gone.example.com. 300 IN A 5.6.7.8")
+
+	soa, _ := dns.NewRR("example.com. 300 IN SOA ns.example.com. admin.example.com. 1 86400 7200 100800 300")
+
+	c := &RcCache{}
+	c.Set(DoNotFlatten, "example.com.", dns.TypeA, &dns.Msg{Answer: []dns.RR{rr}}, 300, nil)
+	c.Set(DoNotFlatten, "gone.example.com.", dns.TypeA, &dns.Msg{Answer: []dns.RR{expired}}, 0, nil)
+	nxdomain := &dns.Msg{Ns: []dns.RR{soa}}
+	nxdomain.Rcode = dns.RcodeNameError
+	c.Set(DoNotFlatten, "nothere.example.com.", dns.TypeA, nxdomain, 300, nil)
+
+	path := filepath.Join(t.TempDir(), "cache.json")
+	if err := c.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &RcCache{}
+	count, err := restored.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 restored entries, got %d", count)
+	}
+	entry, ok, remaining := restored.Get("example.com.", dns.TypeA, nil)
+	if !ok || len(entry.Targets) != 1 {
+		t.Fatalf("Expected example.com. to be restored, got %v", entry)
+	}
+	answers := entry.Targets
+	if answers[0].(*dns.A).A.String() != "1.2.3.4" {
+		t.Errorf("Unexpected restored record %s", answers[0])
+	}
+	if answers[0].Header().Ttl > remaining {
+		t.Errorf("TTL %d exceeds remaining lifetime %d", answers[0].Header().Ttl, remaining)
+	}
+	if _, ok, _ := restored.Get("example.com.", dns.TypeAAAA, nil); ok {
+		t.Error("An A answer should not be served for an AAAA question")
+	}
+	if _, ok, _ := restored.Get("gone.example.com.", dns.TypeA, nil); ok {
+		t.Error("Expired entry should not have been restored")
+	}
+	entry, ok, _ = restored.Get("nothere.example.com.", dns.TypeA, nil)
+	if !ok || entry.Rcode != dns.RcodeNameError || len(entry.Ns) != 1 {
+		t.Errorf("Expected the negative answer to be restored, got %v", entry)
+	}
+}
+
+func TestScopedAnswers(t *testing.T) {
+	global, _ := dns.NewRR("cdn.example.com. 300 IN A 1.1.1.1")
+	local, _ := dns.NewRR("cdn.example.com. 300 IN A 2.2.2.2")
+	_, scope, _ := net.ParseCIDR("192.0.2.0/24")
+
+	c := &RcCache{}
+	c.Set(DoNotFlatten, "cdn.example.com.", dns.TypeA, &dns.Msg{Answer: []dns.RR{global}}, 300, nil)
+	c.Set(DoNotFlatten, "cdn.example.com.", dns.TypeA, &dns.Msg{Answer: []dns.RR{local}}, 300, scope)
+
+	path := filepath.Join(t.TempDir(), "cache.json")
+	if err := c.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	restored := &RcCache{}
+	if _, err := restored.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		client string
+		want   string
+		scope  uint8
+	}{
+		{"192.0.2.10", "2.2.2.2", 24},
+		{"198.51.100.10", "1.1.1.1", 0},
+		{"2001:db8::1", "1.1.1.1", 0},
+	} {
+		entry, ok, _ := restored.Get("cdn.example.com.", dns.TypeA, net.ParseIP(test.client))
+		if !ok {
+			t.Fatalf("Expected an answer for %s", test.client)
+		}
+		if got := entry.Targets[0].(*dns.A).A.String(); got != test.want || entry.ScopePrefix != test.scope {
+			t.Errorf("Client %s: expected %s/%d, got %s/%d", test.client, test.want, test.scope, got, entry.ScopePrefix)
+		}
+	}
+}
+
+func TestStale(t *testing.T) {
+	rr, _ := dns.NewRR("example.com. 300 IN A 1.2.3.4")
+	c := &RcCache{MaxStale: time.Hour}
+	c.Set(DoNotFlatten, "example.com.", dns.TypeA, &dns.Msg{Answer: []dns.RR{rr}}, 0, nil)
+
+	if _, ok, _ := c.Get("example.com.", dns.TypeA, nil); ok {
+		t.Error("Expired entry should not be served")
+	}
+	entry, ok := c.GetStale("example.com.", dns.TypeA, nil)
+	if !ok || entry.Targets[0].Header().Ttl != StaleTTL {
+		t.Errorf("Expected a stale answer, got %v", entry)
+	}
+
+	c.MaxStale = 0
+	if _, ok := c.GetStale("example.com.", dns.TypeA, nil); ok {
+		t.Error("Stale answers should not be served unless configured")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	rr, _ := dns.NewRR("example.com. 300 IN A 1.2.3.4")
+	cname, _ := dns.NewRR("www.example.com. 300 IN CNAME example.com.")
+	_, office, _ := net.ParseCIDR("192.0.2.0/24")
+	_, home, _ := net.ParseCIDR("2001:db8::/48")
+	c := &RcCache{MaxStale: time.Hour}
+	c.Set(DoNotFlatten, "old.example.com.", dns.TypeA, &dns.Msg{Answer: []dns.RR{rr}}, 300, office)
+	c.Set(DoNotFlatten, "new.example.com.", dns.TypeA, &dns.Msg{Answer: []dns.RR{rr}}, 300, home)
+	c.Set(Flatten, "www.example.com.", dns.TypeCNAME, &dns.Msg{Answer: []dns.RR{cname}}, 300, nil)
+	c.Set(DoNotFlatten, "stale.example.com.", dns.TypeA, &dns.Msg{Answer: []dns.RR{rr}}, 300, nil)
+
+	// Nobody asked for these again, well past their time.
+	for _, entryKey := range []string{
+		scopedKey("old.example.com.", dns.TypeA, office),
+		key("www.example.com.", dns.TypeCNAME),
+	} {
+		entry := c.Entries[entryKey]
+		entry.ExpireTS -= 2 * 3600
+		c.Entries[entryKey] = entry
+	}
+	// This one may still be served stale.
+	entry := c.Entries[key("stale.example.com.", dns.TypeA)]
+	entry.ExpireTS -= 1800
+	c.Entries[key("stale.example.com.", dns.TypeA)] = entry
+
+	c.swept = 0
+	c.Set(DoNotFlatten, "example.com.", dns.TypeA, &dns.Msg{Answer: []dns.RR{rr}}, 300, nil)
+	if c.Len() != 3 {
+		t.Errorf("Expected 3 entries left, got %d", c.Len())
+	}
+	if _, ok := c.GetStale("stale.example.com.", dns.TypeA, nil); !ok {
+		t.Error("Expected the entry within its stale period to be kept")
+	}
+	if len(c.Scopes) != 1 || len(c.Scopes[key("new.example.com.", dns.TypeA)]) != 1 {
+		t.Errorf("Expected only the live scope to be kept, got %v", c.Scopes)
+	}
+	if len(c.BackRef) != 0 {
+		t.Errorf("Expected the back reference to go with its entry, got %v", c.BackRef)
+	}
+}
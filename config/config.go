@@ -3,16 +3,251 @@ package config
 import (
 	"fmt"
 	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/fusion/kittendns/secret"
+	"github.com/fusion/kittendns/version"
 	"github.com/hydronica/toml"
+	"github.com/miekg/dns"
 )
 
+type Upstream struct {
+	// May be suffixed with [:port]
+	// Use tls://host[:port] for DNS over TLS, https://host/path for DNS over HTTPS.
+	Address string
+	// In milliseconds. Defaults to the parent's timeout.
+	Timeout uint32
+	// TLS only: name expected in the server's certificate, if the address
+	// does not already say so.
+	ServerName string
+	// TLS only: PEM bundle of the authorities to trust, instead of the system's.
+	CAFile string
+}
+
 type Parent struct {
 	// May be suffixed with [:port]
 	Address string
+	// Additional parents. If Address is set, it is considered the first one.
+	Upstream []Upstream
+	// How to pick a parent: "sequential" (failover, the default), "random",
+	// "roundrobin" or "fastest" (lowest measured latency)
+	Strategy string
+	// In milliseconds, for parents that do not specify their own.
+	Timeout uint32
+	// Consecutive failures before a parent is taken out of rotation: its
+	// circuit opens.
+	MaxFailures uint32
+	// Seconds between probes of the parents that were taken out of rotation.
+	ProbeInterval uint32
+	// Failures, or timeouts, within FailureWindow seconds (30 by default)
+	// that also open a parent's circuit, even when it answers in between.
+	WindowFailures uint32
+	FailureWindow  uint32
+	// Seconds an open circuit waits before letting HalfOpenTrials trial
+	// queries through (1 by default). It closes again if they succeed.
+	Cooldown       uint32
+	HalfOpenTrials uint32
+	// Do not set the "recursion desired" flag, e.g. when talking to
+	// authoritative servers.
+	NoRecursion bool
+	// Only talk to these parents over TCP.
+	TCPOnly bool
+	// Sign queries with this TSIG key name and (base64) secret.
+	TsigKey    string
+	TsigSecret string
+	// Defaults to hmac-sha256.
+	TsigAlgorithm string
+}
+
+// Forward sends queries for a domain, and its subdomains, to their own parents
+// rather than to the default one.
+type Forward struct {
+	Domain string
+	Parent
+}
+
+// EDNS Client Subnet (RFC 7871)
+type ClientSubnet struct {
+	// Only honour the subnets sent by these clients (e.g. a central resolver).
+	// No one is trusted if empty: the client's own address is used instead.
+	Trusted []string
+	// Pass our clients' network on to our parents
+	Forward bool
+	// Longest prefixes disclosed to our parents: 24 and 56 by default.
+	SourcePrefix4 uint8
+	SourcePrefix6 uint8
+}
+
+// Extended DNS Errors (RFC 8914) tell clients why an answer was made up or
+// could not be obtained.
+type ExtendedErrors struct {
+	Disabled bool
+	// Extra text sent along with an error, by error name, e.g.
+	// blocked = "Blocked by your friendly IT department"
+	Text map[string]string
+}
+
+// DNS Cookies (RFC 7873) let clients prove that they are not spoofing
+// their address.
+type Cookies struct {
+	Enabled bool
+	// Answer BADCOOKIE to UDP clients that send a cookie, but not a valid
+	// server cookie of ours.
+	Enforce bool
+	// 16 hex encoded bytes, shared by the servers answering for the same
+	// address. Otherwise, a random secret is used, and rotated.
+	Secret string
+	// Hours between two rotations of the random secret, 24 by default.
+	Rotation uint32
+}
+
+// How we introduce ourselves to CHAOS class queries (hostname.bind,
+// version.bind...) and to clients asking for our NSID.
+type Identity struct {
+	// Defaults to the host's name
+	Hostname string
+	// Defaults to our release
+	Version     string
+	HideVersion bool
+	// Defaults to the hostname
+	NSID   string
+	NoNSID bool
+}
+
+// RFC 8482: answers to ANY queries make for great amplification attacks.
+type Any struct {
+	// "minimal" (default) answers with a single RRset, "hinfo" with a
+	// synthesized HINFO record.
+	Policy string
+	// Answer with every RRset over TCP, or to TSIG authenticated clients.
+	FullOverTCP  bool
+	FullWithTSIG bool
+}
+
+// Response Rate Limiting, so that we are of little use in reflection
+// attacks. Rates are per second, for identical responses sent to the same
+// network. 0 means no limit.
+type RRL struct {
+	ResponsesPerSecond uint32
+	NXDomainsPerSecond uint32
+	ErrorsPerSecond    uint32
+	// Every slip-th dropped response is sent truncated instead, so that
+	// genuine clients retry over TCP. 0 never does.
+	Slip uint32
+	// Networks are /24 and /56 by default.
+	IPv4Prefix uint8
+	IPv6Prefix uint8
+	// Responses tracked at once, 100000 by default. When full, the least
+	// recently seen ones are forgotten.
+	TableSize uint32
+	// Only log what would be dropped.
+	LogOnly bool
+}
+
+// Per client query limits, for clients that misbehave.
+type ClientLimit struct {
+	// Queries per second, and how many may be sent at once. 0 means no limit.
+	QPS   uint32
+	Burst uint32
+	// What makes a client: "ip" (default), "prefix", "tsig" (key name, or ip
+	// for unsigned queries) or "ecs" (its client subnet, if trusted, or ip)
+	Identity string
+	// Networks for the prefix identity: /24 and /56 by default.
+	IPv4Prefix uint8
+	IPv6Prefix uint8
+	// Networks, or addresses, that are never limited.
+	Exempt []string
+	// "refuse" (default) or "drop" queries over the limit.
+	Action string
+	// Clients tracked at once, 100000 by default. When full, the least
+	// recently seen ones are forgotten.
+	TableSize uint32
+}
+
+// Each listener may have its own recursion policy, e.g. recursion for the
+// internal network only.
+type Listener struct {
+	// "ip[:port]", port 53 by default
+	Address string
+	// How rules refer to this listener
+	Name string
+	// Replaces settings.allowrecursion for this listener
+	AllowRecursion []string
+	NoRecursion    bool
+}
+
+// A named list of networks and domains, for rules and other subsystems to
+// look values up in.
+type List struct {
+	Name string
+	// Networks ("10.0.0.0/8"), addresses, or domains, which also match their
+	// subdomains.
+	Entries []string
+	// One entry per line, '#' starting a comment at the beginning of a line
+	// or after a space. Reloaded when changed.
+	File string
 }
+
+// A view is what some clients see: its own zones, rules and forwarding, in
+// place of the top level ones. Definitions it lacks are the top level ones.
+type View struct {
+	Name string
+	// Networks, addresses or TSIG key names of the clients that see this
+	// view; anyone if empty.
+	Match []string
+	// Names of the listeners serving this view; all of them if empty.
+	Listener []string
+	Zone     []Zone
+	Rule     []Rule
+	Forward  []Forward
+	// Replaces the listener's, or settings.allowrecursion, for this view
+	AllowRecursion []string
+	NoRecursion    bool
+}
+
+// A source of domains to block, or to never block.
+type Blocklist struct {
+	// Shows up in the reason given for blocking; defaults to the file name.
+	Name string
+	// Hosts ("0.0.0.0 ads.example.com"), AdBlock ("||ads.example.com^") or
+	// plain domain lists, all mixed if need be. Reloaded when changed.
+	File    string
+	Entries []string
+	// An allowlist: its domains are never blocked.
+	Allow bool
+}
+
+// A Response Policy Zone, read from a file or transferred from its primary.
+type RPZ struct {
+	// Name of the zone, e.g. "rpz.example.com."
+	Zone string
+	File string
+	// "ip[:port]" to transfer the zone from (AXFR)
+	Primary string
+	// Seconds between two transfers; the zone's SOA refresh by default.
+	Refresh uint32
+	// Overrides the policy of every trigger: "nxdomain", "nodata",
+	// "passthru", "drop", "tcp-only", or "disabled" to only log hits.
+	Policy string
+}
+
+// How blocked names are answered.
+type Blocking struct {
+	// "nxdomain" (default), "null" (0.0.0.0 and ::), "sinkhole" (the addresses
+	// below) or "refuse".
+	Response     string
+	SinkholeIPv4 string
+	SinkholeIPv6 string
+	// TTL of made up addresses, 60 seconds by default
+	TTL uint32
+	// Do not log blocked queries, and why they were.
+	NoLog bool
+}
+
 type Settings struct {
 	DebugLevel uint8
 	AutoReload bool
@@ -28,13 +263,38 @@ type Settings struct {
 	Lazy bool
 	// A caching DNS will not refresh its knowledge until Ttl value expires
 	Cache bool
+	// If set, the cache is written to this file when stopping, and read back
+	// when starting, so that a restart does not flush it.
+	CacheFile string
+	// Seconds expired cache entries may still be served, should our parents
+	// fail us (RFC 8767)
+	ServeStale uint32
 	// If true, CNAME chains will be merged into a single record
 	Flatten bool
 	// Disabling the rule engine speeds up simple DNS lookups
 	DisableRuleEngine bool
+	// Largest UDP answer sent to EDNS clients, 1232 by default. Larger
+	// answers are truncated, so that clients retry over TCP.
+	MaxUDPSize uint16
+	// Networks, addresses and TSIG key names allowed to recurse. Loopback and
+	// private networks only, if empty.
+	AllowRecursion []string
 
 	// DNS to recurse to when an authoritative answer does not exist.
-	Parent Parent
+	Parent         Parent
+	ClientSubnet   ClientSubnet
+	ExtendedErrors ExtendedErrors
+	Cookies        Cookies
+	Identity       Identity
+	Any            Any
+	RRL            RRL
+	ClientLimit    ClientLimit
+	// Serve metrics as JSON at http://<address>/debug/vars
+	MetricsListener string
+	Blocking        Blocking
+	// Without a parent, resolve names ourselves, starting from the root
+	// servers listed in this root hints file (e.g. named.root)
+	RootHints string
 }
 
 type Auth struct {
@@ -101,6 +361,13 @@ type Zone struct {
 type Rule struct {
 	Condition string
 	Action    string
+	// "query", to run before looking anything up, or "answer" (default), to
+	// run on every record of the answer.
+	Phase string
+	// Extended DNS Error attached to the answer, by name ("filtered",
+	// "blocked", ...) or code, and its extra text.
+	EDE     string
+	EDEText string
 }
 
 type Plugin struct {
@@ -113,13 +380,30 @@ type Plugin struct {
 }
 
 type Config struct {
-	Settings Settings
-	Zone     []Zone
-	Records  map[string]Record
-	Rule     []Rule
-	Plugin   []Plugin
-	Monitor  []string
-	Secret   secret.Secret
+	Settings  Settings
+	Zone      []Zone
+	Records   map[string]Record
+	Rule      []Rule
+	Forward   []Forward
+	Listener  []Listener
+	List      []List
+	Blocklist []Blocklist
+	// In priority order
+	RPZ []RPZ
+	// The first view matching a client answers it.
+	View    []View
+	Plugin  []Plugin
+	Monitor []string
+	Secret  secret.Secret
+}
+
+// Checks that need more than this package knows, such as compiling rules.
+// They run once the configuration is otherwise complete.
+var checks []func(*Config) error
+
+// RegisterCheck has GetConfig run check on every configuration it loads.
+func RegisterCheck(check func(*Config) error) {
+	checks = append(checks, check)
 }
 
 func GetConfig() *Config {
@@ -133,10 +417,285 @@ func GetConfig() *Config {
 		log.Fatal(err)
 	}
 	config.Secret = secret
+	config.prepare()
+	return &config
+}
 
-	// Default parent dns to port 53 is not set, but parent _is_ set
-	if config.Settings.Parent.Address != "" && !strings.Contains(config.Settings.Parent.Address, ":") {
-		config.Settings.Parent.Address = fmt.Sprintf("%s:%d", config.Settings.Parent.Address, 53)
+// ParseConfig reads a configuration from text, with no secret, the way
+// GetConfig reads config.toml.
+func ParseConfig(text string) *Config {
+	var config Config
+	if _, err := toml.Decode(text, &config); err != nil {
+		log.Fatal(err)
 	}
+	config.prepare()
 	return &config
 }
+
+// prepare fills in defaults and checks the configuration, which is fatal if
+// anything is wrong with it.
+func (config *Config) prepare() {
+	normalizeParent(&config.Settings.Parent)
+	normalizeForwards(config.Forward)
+	identity := &config.Settings.Identity
+	if identity.Hostname == "" {
+		identity.Hostname, _ = os.Hostname()
+	}
+	if identity.Version == "" {
+		identity.Version = "KittenDNS " + version.Version
+	}
+	if identity.NSID == "" {
+		identity.NSID = identity.Hostname
+	}
+	switch config.Settings.Any.Policy {
+	case "":
+		config.Settings.Any.Policy = "minimal"
+	case "minimal", "hinfo":
+	default:
+		log.Fatalf("Unknown ANY policy: %s", config.Settings.Any.Policy)
+	}
+	if len(config.Settings.AllowRecursion) == 0 {
+		config.Settings.AllowRecursion = append([]string{}, defaultAllowRecursion...)
+	}
+	normalizeACL(config.Settings.AllowRecursion)
+	for idx := range config.Listener {
+		listener := &config.Listener[idx]
+		listener.Address = withDefaultPort(listener.Address)
+		if listener.Name == "" {
+			listener.Name = listener.Address
+		}
+		normalizeACL(listener.AllowRecursion)
+	}
+	limit := &config.Settings.ClientLimit
+	switch limit.Identity {
+	case "":
+		limit.Identity = "ip"
+	case "ip", "prefix", "tsig":
+	case "ecs":
+		if len(config.Settings.ClientSubnet.Trusted) == 0 {
+			log.Fatal("The ecs client identity requires trusted client subnet sources")
+		}
+	default:
+		log.Fatalf("Unknown client identity: %s", limit.Identity)
+	}
+	switch limit.Action {
+	case "":
+		limit.Action = "refuse"
+	case "refuse", "drop":
+	default:
+		log.Fatalf("Unknown client limit action: %s", limit.Action)
+	}
+	names := map[string]bool{}
+	for _, list := range config.List {
+		if list.Name == "" {
+			log.Fatal("Unnamed list")
+		}
+		if names[list.Name] {
+			log.Fatalf("List %s defined twice", list.Name)
+		}
+		names[list.Name] = true
+	}
+	for idx := range config.Blocklist {
+		blocklist := &config.Blocklist[idx]
+		if blocklist.File == "" && len(blocklist.Entries) == 0 {
+			log.Fatalf("Blocklist %d has neither file nor entries", idx+1)
+		}
+		if blocklist.Name == "" {
+			blocklist.Name = filepath.Base(blocklist.File)
+			if blocklist.File == "" {
+				blocklist.Name = fmt.Sprintf("blocklist %d", idx+1)
+			}
+		}
+	}
+	for idx := range config.RPZ {
+		rpz := &config.RPZ[idx]
+		if rpz.Zone == "" {
+			log.Fatalf("Response policy zone %d has no name", idx+1)
+		}
+		rpz.Zone = dns.Fqdn(strings.ToLower(rpz.Zone))
+		if (rpz.File == "") == (rpz.Primary == "") {
+			log.Fatalf("Response policy zone %s needs either a file or a primary", rpz.Zone)
+		}
+		if rpz.Primary != "" {
+			rpz.Primary = withDefaultPort(rpz.Primary)
+		}
+		switch rpz.Policy {
+		case "", "nxdomain", "nodata", "passthru", "drop", "tcp-only", "disabled":
+		default:
+			log.Fatalf("Unknown policy for response policy zone %s: %s", rpz.Zone, rpz.Policy)
+		}
+	}
+	blocking := &config.Settings.Blocking
+	switch blocking.Response {
+	case "":
+		blocking.Response = "nxdomain"
+	case "nxdomain", "null", "refuse":
+	case "sinkhole":
+		if blocking.SinkholeIPv4 == "" && blocking.SinkholeIPv6 == "" {
+			log.Fatal("No sinkhole address to answer blocked queries with")
+		}
+	default:
+		log.Fatalf("Unknown blocking response: %s", blocking.Response)
+	}
+	if ip := net.ParseIP(blocking.SinkholeIPv4); blocking.SinkholeIPv4 != "" && (ip == nil || ip.To4() == nil) {
+		log.Fatalf("Bad sinkhole IPv4 address: %s", blocking.SinkholeIPv4)
+	}
+	if ip := net.ParseIP(blocking.SinkholeIPv6); blocking.SinkholeIPv6 != "" && (ip == nil || ip.To4() != nil) {
+		log.Fatalf("Bad sinkhole IPv6 address: %s", blocking.SinkholeIPv6)
+	}
+	if blocking.TTL == 0 {
+		blocking.TTL = 60
+	}
+	for name := range config.Settings.ExtendedErrors.Text {
+		if _, ok := ExtendedErrorCode(name); !ok {
+			log.Fatalf("Unknown extended error: %s", name)
+		}
+	}
+	validateRules(config.Rule)
+	normalizeViews(config)
+	for _, check := range checks {
+		if err := check(config); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func normalizeForwards(forwards []Forward) {
+	for idx := range forwards {
+		forward := &forwards[idx]
+		forward.Domain = strings.ToLower(forward.Domain)
+		if !strings.HasSuffix(forward.Domain, ".") {
+			forward.Domain = forward.Domain + "."
+		}
+		normalizeParent(&forward.Parent)
+		if len(forward.Upstream) == 0 {
+			log.Fatalf("No upstream defined to forward %s to", forward.Domain)
+		}
+	}
+}
+
+func validateRules(rules []Rule) {
+	for _, rule := range rules {
+		if _, ok := ExtendedErrorCode(rule.EDE); rule.EDE != "" && !ok {
+			log.Fatalf("Unknown extended error in rule %s: %s", rule.Condition, rule.EDE)
+		}
+	}
+}
+
+// Views inherit the zones, rules and forwarding definitions they lack.
+func normalizeViews(config *Config) {
+	listeners := map[string]bool{}
+	for _, listener := range config.Listener {
+		listeners[listener.Name] = true
+	}
+	for idx := range config.View {
+		view := &config.View[idx]
+		if view.Name == "" {
+			view.Name = fmt.Sprintf("view %d", idx+1)
+		}
+		for _, name := range view.Listener {
+			if !listeners[name] {
+				log.Fatalf("Unknown listener in view %s: %s", view.Name, name)
+			}
+		}
+		normalizeACL(view.Match)
+		normalizeACL(view.AllowRecursion)
+		if len(view.Zone) == 0 {
+			view.Zone = config.Zone
+		}
+		if len(view.Rule) == 0 {
+			view.Rule = config.Rule
+		} else {
+			validateRules(view.Rule)
+		}
+		if len(view.Forward) == 0 {
+			view.Forward = config.Forward
+		} else {
+			normalizeForwards(view.Forward)
+		}
+	}
+}
+
+// Who may recurse when not told otherwise: we are not an open resolver.
+var defaultAllowRecursion = []string{
+	"127.0.0.0/8", "::1",
+	// RFC 1918, and IPv6 unique local addresses
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7",
+}
+
+// Access lists mix networks, addresses and TSIG key names. Key names are
+// made fully qualified, in lower case.
+func normalizeACL(acl []string) {
+	for idx, entry := range acl {
+		if _, _, err := net.ParseCIDR(entry); err == nil || net.ParseIP(entry) != nil {
+			continue
+		}
+		acl[idx] = dns.Fqdn(strings.ToLower(entry))
+	}
+}
+
+// ExtendedErrorCode looks up an extended error by code or name. Names are
+// those of RFC 8914, case, spaces and dashes notwithstanding.
+func ExtendedErrorCode(name string) (uint16, bool) {
+	if code, err := strconv.ParseUint(name, 10, 16); err == nil {
+		return uint16(code), true
+	}
+	name = simplifyErrorName(name)
+	for code, description := range dns.ExtendedErrorCodeToString {
+		if simplifyErrorName(description) == name {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+func simplifyErrorName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' || r == '_' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(name))
+}
+
+// TextFor returns the extra text configured for an extended error.
+func (e ExtendedErrors) TextFor(code uint16) string {
+	for name, text := range e.Text {
+		if known, _ := ExtendedErrorCode(name); known == code {
+			return text
+		}
+	}
+	return ""
+}
+
+func normalizeParent(parent *Parent) {
+	// Default parent dns to port 53 is not set, but parent _is_ set
+	if parent.Address != "" {
+		parent.Address = withDefaultPort(parent.Address)
+		parent.Upstream = append(
+			[]Upstream{{Address: parent.Address}},
+			parent.Upstream...)
+	}
+	for idx := range parent.Upstream {
+		parent.Upstream[idx].Address = withDefaultPort(parent.Upstream[idx].Address)
+	}
+	if parent.TsigKey != "" && !strings.HasSuffix(parent.TsigKey, ".") {
+		parent.TsigKey = parent.TsigKey + "."
+	}
+}
+
+func withDefaultPort(address string) string {
+	if strings.HasPrefix(address, "https://") {
+		return address
+	}
+	if strings.HasPrefix(address, "tls://") {
+		if strings.Contains(strings.TrimPrefix(address, "tls://"), ":") {
+			return address
+		}
+		return fmt.Sprintf("%s:%d", address, 853)
+	}
+	if strings.Contains(address, ":") {
+		return address
+	}
+	return fmt.Sprintf("%s:%d", address, 53)
+}
@@ -0,0 +1,179 @@
+// Package cookie implements DNS Cookies (RFC 7873), with server cookies
+// built the interoperable way described in RFC 9018.
+package cookie
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type Status int
+
+const (
+	// The client did not send a cookie.
+	Absent Status = iota
+	// The client sent its own cookie, but not a server cookie of ours.
+	ClientOnly
+	// The server cookie is ours: the client is who it claims to be.
+	Valid
+	// The option does not look like a cookie: the query is a FORMERR.
+	Malformed
+)
+
+const (
+	clientLength = 8
+	serverLength = 16
+	version      = 1
+	// RFC 9018 section 4.3
+	maxAge    = time.Hour
+	maxFuture = 5 * time.Minute
+	// Cookies older than this are replaced with a fresh one.
+	refreshAge = 30 * time.Minute
+
+	DefaultRotation = 24 * time.Hour
+)
+
+var ErrBadSecret = errors.New("cookie secret must be 16 bytes, hex encoded")
+
+// Jar issues and checks server cookies. Unless a secret is shared between
+// servers, ours is random and rotated; cookies issued with the previous
+// secret remain valid until the next rotation.
+type Jar struct {
+	sync.Mutex
+	secret   [16]byte
+	previous [16]byte
+	fixed    bool
+	rotation time.Duration
+	rotated  time.Time
+	now      func() time.Time
+}
+
+// NewJar builds a jar from an hex encoded secret, or from a random secret
+// rotated every rotation if secretHex is empty.
+func NewJar(secretHex string, rotation time.Duration) (*Jar, error) {
+	jar := &Jar{now: time.Now}
+	if err := jar.Configure(secretHex, rotation); err != nil {
+		return nil, err
+	}
+	return jar, nil
+}
+
+// Configure applies new settings to the jar. Cookies issued with the secret
+// it replaces remain valid until the next rotation, so that reloading our
+// configuration does not lock clients out.
+func (j *Jar) Configure(secretHex string, rotation time.Duration) error {
+	if rotation <= 0 {
+		rotation = DefaultRotation
+	}
+	var secret [16]byte
+	fixed := secretHex != ""
+	if fixed {
+		raw, err := hex.DecodeString(secretHex)
+		if err != nil || len(raw) != len(secret) {
+			return ErrBadSecret
+		}
+		copy(secret[:], raw)
+	}
+
+	j.Lock()
+	defer j.Unlock()
+	j.rotation = rotation
+	// A new jar has no secret to keep.
+	initialized := !j.rotated.IsZero()
+	if initialized && fixed == j.fixed && (!fixed || secret == j.secret) {
+		return nil
+	}
+	if !fixed {
+		if _, err := rand.Read(secret[:]); err != nil {
+			return err
+		}
+	}
+	j.previous = secret
+	if initialized {
+		j.previous = j.secret
+	}
+	j.secret = secret
+	j.fixed = fixed
+	j.rotated = j.now()
+	return nil
+}
+
+// Check validates the cookie option sent by client, and returns the cookie to
+// send back: the client's own, followed by a server cookie.
+func (j *Jar) Check(option *dns.EDNS0_COOKIE, client net.IP) (Status, *dns.EDNS0_COOKIE) {
+	if option == nil {
+		return Absent, nil
+	}
+	raw, err := hex.DecodeString(option.Cookie)
+	// RFC 7873 section 5.2.2
+	if err != nil || len(raw) < clientLength || (len(raw) > clientLength && len(raw) < clientLength+8) || len(raw) > clientLength+32 {
+		return Malformed, nil
+	}
+	if ip4 := client.To4(); ip4 != nil {
+		client = ip4
+	}
+
+	now := j.now()
+	current, previous := j.secrets(now)
+	status := ClientOnly
+	if len(raw) == clientLength+serverLength && raw[clientLength] == version {
+		issued := time.Unix(int64(binary.BigEndian.Uint32(raw[clientLength+4:])), 0)
+		if issued.Before(now.Add(maxFuture)) && issued.After(now.Add(-maxAge)) {
+			for _, secret := range [][16]byte{current, previous} {
+				sum := hash(secret, raw[:clientLength+8], client)
+				if hmac.Equal(sum[:], raw[clientLength+8:]) {
+					status = Valid
+					break
+				}
+			}
+			// Still fresh: no need to hand out a new one.
+			if status == Valid && issued.After(now.Add(-refreshAge)) {
+				return status, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: option.Cookie}
+			}
+		}
+	}
+	return status, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(issue(current, raw[:clientLength], client, now)),
+	}
+}
+
+func (j *Jar) secrets(now time.Time) ([16]byte, [16]byte) {
+	j.Lock()
+	defer j.Unlock()
+	if !j.fixed && now.Sub(j.rotated) >= j.rotation {
+		j.previous = j.secret
+		if _, err := rand.Read(j.secret[:]); err != nil {
+			// Better keep the old secret than lock everyone out.
+			j.secret = j.previous
+		}
+		j.rotated = now
+	}
+	return j.secret, j.previous
+}
+
+// issue builds a client cookie followed by a server cookie: version,
+// reserved bytes, timestamp and hash (RFC 9018 section 4).
+func issue(secret [16]byte, clientCookie []byte, client net.IP, now time.Time) []byte {
+	cookie := make([]byte, clientLength+8, clientLength+serverLength)
+	copy(cookie, clientCookie)
+	cookie[clientLength] = version
+	binary.BigEndian.PutUint32(cookie[clientLength+4:], uint32(now.Unix()))
+	sum := hash(secret, cookie, client)
+	return append(cookie, sum[:]...)
+}
+
+func hash(secret [16]byte, prefix []byte, client net.IP) [8]byte {
+	data := make([]byte, 0, len(prefix)+net.IPv6len)
+	data = append(data, prefix...)
+	data = append(data, client...)
+	return siphash(secret, data)
+}
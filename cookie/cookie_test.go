@@ -0,0 +1,123 @@
+package cookie
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSiphash(t *testing.T) {
+	var key [16]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	data := make([]byte, 15)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	// Reference implementation's vectors
+	if sum := siphash(key, nil); hex.EncodeToString(sum[:]) != "310e0edd47db6f72" {
+		t.Errorf("Unexpected hash of nothing: %x", sum)
+	}
+	if sum := siphash(key, data); hex.EncodeToString(sum[:]) != "e545be4961ca29a1" {
+		t.Errorf("Unexpected hash of 15 bytes: %x", sum)
+	}
+}
+
+func fixedJar(t *testing.T, secret string, now time.Time) *Jar {
+	jar, err := NewJar(secret, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jar.now = func() time.Time { return now }
+	return jar
+}
+
+func TestRFC9018Vector(t *testing.T) {
+	now := time.Unix(1559731985, 0)
+	jar := fixedJar(t, "e5e973e5a6b2a43f48e7dc849e37bfcf", now)
+	client := net.ParseIP("198.51.100.100")
+
+	status, reply := jar.Check(&dns.EDNS0_COOKIE{Cookie: "2464c4abcf10c957"}, client)
+	if status != ClientOnly {
+		t.Errorf("Expected a client only cookie, got %d", status)
+	}
+	if reply.Cookie != "2464c4abcf10c957010000005cf79f111f8130c3eee29480" {
+		t.Errorf("Unexpected server cookie %s", reply.Cookie)
+	}
+
+	status, _ = jar.Check(reply, client)
+	if status != Valid {
+		t.Errorf("Expected our own cookie to be valid, got %d", status)
+	}
+	if status, _ = jar.Check(reply, net.ParseIP("198.51.100.101")); status != ClientOnly {
+		t.Errorf("Expected a cookie from another address to be rejected, got %d", status)
+	}
+	jar.now = func() time.Time { return now.Add(2 * time.Hour) }
+	if status, _ = jar.Check(reply, client); status != ClientOnly {
+		t.Errorf("Expected an old cookie to be rejected, got %d", status)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	jar, err := NewJar("", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	jar.now = func() time.Time { return now }
+	client := net.ParseIP("2001:db8::1")
+
+	_, reply := jar.Check(&dns.EDNS0_COOKIE{Cookie: "0102030405060708"}, client)
+	now = now.Add(2 * time.Minute)
+	if status, _ := jar.Check(reply, client); status != Valid {
+		t.Errorf("Expected a cookie to survive one rotation, got %d", status)
+	}
+	now = now.Add(2 * time.Minute)
+	if status, _ := jar.Check(reply, client); status != ClientOnly {
+		t.Errorf("Expected a cookie not to survive two rotations, got %d", status)
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	jar := fixedJar(t, "", time.Now())
+	for _, cookie := range []string{"0102", "01020304050607080910", "zz"} {
+		if status, _ := jar.Check(&dns.EDNS0_COOKIE{Cookie: cookie}, net.ParseIP("192.0.2.1")); status != Malformed {
+			t.Errorf("Expected %s to be malformed, got %d", cookie, status)
+		}
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	jar, err := NewJar("", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	jar.now = func() time.Time { return now }
+	client := net.ParseIP("192.0.2.1")
+	_, reply := jar.Check(&dns.EDNS0_COOKIE{Cookie: "0102030405060708"}, client)
+
+	// Reloading the same settings, or another rotation, keeps the secret.
+	for _, rotation := range []time.Duration{time.Hour, 2 * time.Hour} {
+		if err := jar.Configure("", rotation); err != nil {
+			t.Fatal(err)
+		}
+		if status, _ := jar.Check(reply, client); status != Valid {
+			t.Errorf("Expected the cookie to survive a reload, got %d", status)
+		}
+	}
+	// A shared secret replaces ours, which remains valid for a while.
+	if err := jar.Configure("e5e973e5a6b2a43f48e7dc849e37bfcf", 0); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := jar.Check(reply, client); status != Valid {
+		t.Errorf("Expected the cookie to survive a new secret, got %d", status)
+	}
+	if err := jar.Configure("zz", 0); err != ErrBadSecret {
+		t.Errorf("Expected a bad secret to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fusion/kittendns/blocklist"
+	"github.com/fusion/kittendns/cache"
+	"github.com/fusion/kittendns/config"
+	"github.com/fusion/kittendns/lists"
+	"github.com/fusion/kittendns/plugins"
+	"github.com/fusion/kittendns/ratelimit"
+	"github.com/fusion/kittendns/rpz"
+	"github.com/fusion/kittendns/upstream"
+	"github.com/miekg/dns"
+)
+
+// These tests answer queries in process, unlike the ones driving dig against
+// a running server.
+
+// testWriter records the response to a query.
+type testWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func newTestWriter(network string) *testWriter {
+	if network == "tcp" {
+		return &testWriter{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	}
+	return &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+}
+
+func (w *testWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+}
+func (w *testWriter) RemoteAddr() net.Addr      { return w.remote }
+func (w *testWriter) WriteMsg(m *dns.Msg) error { w.msg = m; return nil }
+func (w *testWriter) Write(b []byte) (int, error) {
+	w.msg = new(dns.Msg)
+	return len(b), w.msg.Unpack(b)
+}
+func (w *testWriter) Close() error        { return nil }
+func (w *testWriter) TsigStatus() error   { return nil }
+func (w *testWriter) TsigTimersOnly(bool) {}
+func (w *testWriter) Hijack()             {}
+
+// testRecursor answers every question with the same address.
+type testRecursor struct {
+	address string
+	calls   int32
+}
+
+func (r *testRecursor) Exchange(m *dns.Msg) (*dns.Msg, string, error) {
+	atomic.AddInt32(&r.calls, 1)
+	response := new(dns.Msg)
+	response.SetReply(m)
+	if m.Question[0].Qtype == dns.TypeA {
+		rr, _ := dns.NewRR(m.Question[0].Name + " 60 IN A " + r.address)
+		response.Answer = []dns.RR{rr}
+	}
+	return response, "test", nil
+}
+
+// newTestApp builds an application from a configuration, without listening
+// anywhere. Queries it cannot answer go to upstreams.
+func newTestApp(t *testing.T, text string, upstreams Recursor) *App {
+	t.Helper()
+	app := &App{
+		Config:    config.ParseConfig(text),
+		Plugins:   &plugins.Plugins{},
+		Cache:     &cache.RcCache{},
+		Inflight:  &upstream.Coalescer{},
+		Upstreams: upstreams,
+	}
+	var err error
+	if app.Lists, err = lists.New(app.Config.List); err != nil {
+		t.Fatal(err)
+	}
+	if app.Blocklist, err = blocklist.New(app.Config.Blocklist); err != nil {
+		t.Fatal(err)
+	}
+	if app.RPZ, err = rpz.New(app.Config.RPZ); err != nil {
+		t.Fatal(err)
+	}
+	app.RRL = ratelimit.NewRRL(app.Config.Settings.RRL)
+	if app.Limiter, err = ratelimit.NewLimiter(app.Config.Settings.ClientLimit); err != nil {
+		t.Fatal(err)
+	}
+	app.Views = app.newViews()
+	t.Cleanup(func() {
+		for _, view := range app.Views {
+			view.Close()
+		}
+	})
+	return app
+}
+
+// ask sends a query from client, an "address:port", and returns the response.
+func ask(app *App, ctx context.Context, w *testWriter, client string, r *dns.Msg) *dns.Msg {
+	w.msg = nil
+	app.handleDnsRequest(context.WithValue(ctx, "remoteaddr", client), w, r)
+	return w.msg
+}
+
+func query(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	return m
+}
+
+func TestMostSpecificForwarder(t *testing.T) {
+	app := newTestApp(t, `
+[[forward]]
+domain = "corp.internal."
+address = "127.0.0.1:5301"
+
+[[forward]]
+domain = "sub.corp.internal."
+address = "127.0.0.1:5302"
+`, &testRecursor{address: "127.0.0.2"})
+	req := &Request{View: app.Views[0]}
+	forwarders := map[string]Recursor{}
+	for _, forwarder := range req.View.Forwarders {
+		forwarders[forwarder.Domain] = forwarder.Upstreams
+	}
+	for name, expected := range map[string]Recursor{
+		"a.sub.corp.internal.": forwarders["sub.corp.internal."],
+		"sub.corp.internal.":   forwarders["sub.corp.internal."],
+		"x.corp.internal.":     forwarders["corp.internal."],
+		"corp.internal.":       forwarders["corp.internal."],
+		"notcorp.internal.":    app.Upstreams,
+		"example.net.":         app.Upstreams,
+	} {
+		if recursor := app.findRecursor(req, name); recursor != expected {
+			t.Errorf("Wrong recursor for %s", name)
+		}
+	}
+}
+
+// A zone with an answer too large for a plain UDP response.
+const largeZone = `
+[[zone]]
+origin = "example.com."
+TTL = 60
+    [zone.auth]
+    ns = "dns1.example.com"
+    email = "chris.example.com"
+    serial = 1
+
+    [[zone.record]]
+    host = "many"
+    ipv4s = [
+        "192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.5", "192.0.2.6",
+        "192.0.2.7", "192.0.2.8", "192.0.2.9", "192.0.2.10", "192.0.2.11", "192.0.2.12",
+        "192.0.2.13", "192.0.2.14", "192.0.2.15", "192.0.2.16", "192.0.2.17", "192.0.2.18",
+        "192.0.2.19", "192.0.2.20", "192.0.2.21", "192.0.2.22", "192.0.2.23", "192.0.2.24",
+        "192.0.2.25", "192.0.2.26", "192.0.2.27", "192.0.2.28", "192.0.2.29", "192.0.2.30",
+        "192.0.2.31", "192.0.2.32", "192.0.2.33", "192.0.2.34", "192.0.2.35", "192.0.2.36",
+        "192.0.2.37", "192.0.2.38", "192.0.2.39", "192.0.2.40", "192.0.2.41", "192.0.2.42",
+    ]
+`
+
+func TestTruncation(t *testing.T) {
+	app := newTestApp(t, largeZone, nil)
+	for _, test := range []struct {
+		network   string
+		udpSize   uint16
+		maxLen    int
+		truncated bool
+	}{
+		{"udp", 0, dns.MinMsgSize, true},
+		{"udp", 600, 600, true},
+		{"udp", 4096, 4096, false},
+		{"tcp", 0, dns.MaxMsgSize, false},
+	} {
+		r := query("many.example.com.", dns.TypeA)
+		if test.udpSize > 0 {
+			r.SetEdns0(test.udpSize, false)
+		}
+		response := ask(app, context.Background(), newTestWriter(test.network), "127.0.0.1:5353", r)
+		if response == nil {
+			t.Fatalf("No response over %s, size %d", test.network, test.udpSize)
+		}
+		if response.Truncated != test.truncated {
+			t.Errorf("Over %s, size %d: expected truncated %v", test.network, test.udpSize, test.truncated)
+		}
+		if response.Len() > test.maxLen {
+			t.Errorf("Over %s, size %d: response of %d bytes", test.network, test.udpSize, response.Len())
+		}
+		if !test.truncated && len(response.Answer) != 42 {
+			t.Errorf("Over %s, size %d: expected every record, got %d", test.network, test.udpSize, len(response.Answer))
+		}
+	}
+}
+
+func TestBadVersion(t *testing.T) {
+	app := newTestApp(t, largeZone, nil)
+	r := query("many.example.com.", dns.TypeA)
+	r.SetEdns0(1232, false)
+	r.IsEdns0().SetVersion(1)
+	response := ask(app, context.Background(), newTestWriter("udp"), "127.0.0.1:5353", r)
+	if response == nil || response.Rcode != dns.RcodeBadVers {
+		t.Fatalf("Expected BADVERS, got %v", response)
+	}
+	if opt := response.IsEdns0(); opt == nil || opt.Version() != 0 {
+		t.Error("Expected an OPT record for version 0")
+	}
+	if len(response.Answer) > 0 {
+		t.Error("Expected no answer")
+	}
+
+	// Rate limited like any other response
+	app = newTestApp(t, "[settings.rrl]\nerrorspersecond = 1\n"+largeZone, nil)
+	if response := ask(app, context.Background(), newTestWriter("udp"), "192.0.2.1:5353", r); response == nil || response.Rcode != dns.RcodeBadVers {
+		t.Fatalf("Expected BADVERS, got %v", response)
+	}
+	if response := ask(app, context.Background(), newTestWriter("udp"), "192.0.2.1:5353", r); response != nil {
+		t.Errorf("Expected the response to be rate limited, got %v", response)
+	}
+}
+
+func extendedErrors(m *dns.Msg) []*dns.EDNS0_EDE {
+	var errors []*dns.EDNS0_EDE
+	if opt := m.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if ede, ok := option.(*dns.EDNS0_EDE); ok {
+				errors = append(errors, ede)
+			}
+		}
+	}
+	return errors
+}
+
+const blockingRule = `
+[[rule]]
+phase = "query"
+condition = "host == 'blocked.example.net.'"
+action = "nxdomain"
+`
+
+func TestExtendedErrors(t *testing.T) {
+	for _, test := range []struct {
+		settings string
+		text     string
+	}{
+		{"", ""},
+		{"[settings.extendederrors.text]\nblocked = \"Not on my watch\"\n", "Not on my watch"},
+	} {
+		app := newTestApp(t, test.settings+blockingRule, nil)
+		r := query("blocked.example.net.", dns.TypeA)
+		r.SetEdns0(1232, false)
+		response := ask(app, context.Background(), newTestWriter("udp"), "127.0.0.1:5353", r)
+		if response.Rcode != dns.RcodeNameError {
+			t.Fatalf("Expected NXDOMAIN, got %s", dns.RcodeToString[response.Rcode])
+		}
+		errors := extendedErrors(response)
+		if len(errors) != 1 || errors[0].InfoCode != dns.ExtendedErrorCodeBlocked || errors[0].ExtraText != test.text {
+			t.Errorf("Expected a Blocked error saying '%s', got %v", test.text, errors)
+		}
+
+		// Clients that do not speak EDNS get no OPT record.
+		response = ask(app, context.Background(), newTestWriter("udp"), "127.0.0.1:5353", query("blocked.example.net.", dns.TypeA))
+		if response.Rcode != dns.RcodeNameError || response.IsEdns0() != nil {
+			t.Errorf("Expected a plain NXDOMAIN, got %v", response)
+		}
+	}
+}
+
+func TestExtendedErrorsDisabled(t *testing.T) {
+	app := newTestApp(t, "[settings.extendederrors]\ndisabled = true\n"+blockingRule, nil)
+	r := query("blocked.example.net.", dns.TypeA)
+	r.SetEdns0(1232, false)
+	response := ask(app, context.Background(), newTestWriter("udp"), "127.0.0.1:5353", r)
+	if response.IsEdns0() == nil {
+		t.Error("Expected an OPT record")
+	}
+	if errors := extendedErrors(response); len(errors) != 0 {
+		t.Errorf("Expected no extended error, got %v", errors)
+	}
+}
+
+// recurses tells whether client, through listener if any, had the question
+// resolved for it.
+func recurses(t *testing.T, app *App, listener string, client string, r *dns.Msg) bool {
+	t.Helper()
+	ctx := context.Background()
+	for idx := range app.Config.Listener {
+		if app.Config.Listener[idx].Name == listener {
+			ctx = context.WithValue(ctx, "listener", &app.Config.Listener[idx])
+		}
+	}
+	// Nothing from the cache: only a query to our parent tells.
+	app.Cache = &cache.RcCache{}
+	recursor := app.Upstreams.(*testRecursor)
+	calls := recursor.calls
+	response := ask(app, ctx, newTestWriter("udp"), client, r)
+	resolved := recursor.calls > calls
+	if resolved != response.RecursionAvailable {
+		t.Errorf("From %s: recursion available is %v, but resolved is %v", client, response.RecursionAvailable, resolved)
+	}
+	if !resolved && response.Rcode != dns.RcodeRefused {
+		t.Errorf("From %s: expected REFUSED, got %s", client, dns.RcodeToString[response.Rcode])
+	}
+	return resolved
+}
+
+func TestRecursionPolicy(t *testing.T) {
+	// Not an open resolver by default.
+	app := newTestApp(t, "", &testRecursor{address: "192.0.2.10"})
+	for client, allowed := range map[string]bool{
+		"127.0.0.1:5353":     true,
+		"[::1]:5353":         true,
+		"10.1.2.3:5353":      true,
+		"172.16.0.1:5353":    true,
+		"192.168.1.1:5353":   true,
+		"[fd00::1]:5353":     true,
+		"198.51.100.1:5353":  false,
+		"[2001:db8::1]:5353": false,
+	} {
+		if recurses(t, app, "", client, query("example.net.", dns.TypeA)) != allowed {
+			t.Errorf("From %s: expected recursion allowed %v", client, allowed)
+		}
+	}
+
+	app = newTestApp(t, "[settings]\nallowrecursion = [\"198.51.100.0/24\", \"trusted-key.\"]\n", &testRecursor{address: "192.0.2.10"})
+	if !recurses(t, app, "", "198.51.100.1:5353", query("example.net.", dns.TypeA)) {
+		t.Error("Expected a listed network to recurse")
+	}
+	if recurses(t, app, "", "10.1.2.3:5353", query("example.net.", dns.TypeA)) {
+		t.Error("Expected the defaults to be replaced")
+	}
+	signed := query("example.net.", dns.TypeA)
+	signed.SetTsig("trusted-key.", dns.HmacSHA256, 300, 0)
+	if !recurses(t, app, "", "203.0.113.1:5353", signed) {
+		t.Error("Expected a listed key to recurse")
+	}
+}
+
+func TestListenerRecursionPolicy(t *testing.T) {
+	app := newTestApp(t, `
+[settings]
+allowrecursion = ["10.0.0.0/8"]
+
+[[listener]]
+address = "127.0.0.1:5301"
+name = "internal"
+allowrecursion = ["192.168.0.0/16"]
+
+[[listener]]
+address = "127.0.0.1:5302"
+name = "public"
+norecursion = true
+
+[[listener]]
+address = "127.0.0.1:5303"
+name = "default"
+`, &testRecursor{address: "192.0.2.10"})
+	for _, test := range []struct {
+		listener string
+		client   string
+		allowed  bool
+	}{
+		{"internal", "192.168.1.1:5353", true},
+		{"internal", "10.1.2.3:5353", false},
+		{"public", "10.1.2.3:5353", false},
+		{"public", "127.0.0.1:5353", false},
+		{"default", "10.1.2.3:5353", true},
+		{"default", "192.168.1.1:5353", false},
+	} {
+		if recurses(t, app, test.listener, test.client, query("example.net.", dns.TypeA)) != test.allowed {
+			t.Errorf("Through %s, from %s: expected recursion allowed %v", test.listener, test.client, test.allowed)
+		}
+	}
+}
+
+func TestDropRule(t *testing.T) {
+	app := newTestApp(t, `
+[[rule]]
+condition = "answerip == '192.0.2.1'"
+action = "drop"
+
+[[rule]]
+condition = "host == 'silent.example.net.'"
+action = "noresponse"
+
+[[rule]]
+phase = "query"
+condition = "host == 'dropped.example.net.'"
+action = "drop"
+`+largeZone, &testRecursor{address: "192.0.2.2"})
+	// The record goes, the rest of the answer stays.
+	response := ask(app, context.Background(), newTestWriter("tcp"), "127.0.0.1:5353", query("many.example.com.", dns.TypeA))
+	if response == nil || len(response.Answer) != 41 {
+		t.Fatalf("Expected all but one record, got %v", response)
+	}
+	for _, rr := range response.Answer {
+		if rr.(*dns.A).A.String() == "192.0.2.1" {
+			t.Error("Expected 192.0.2.1 to be left out")
+		}
+	}
+	// No response at all
+	if response := ask(app, context.Background(), newTestWriter("tcp"), "127.0.0.1:5353", query("silent.example.net.", dns.TypeA)); response != nil {
+		t.Errorf("Expected no response, got %v", response)
+	}
+	// Nothing to answer, nor to look up
+	calls := app.Upstreams.(*testRecursor).calls
+	response = ask(app, context.Background(), newTestWriter("tcp"), "127.0.0.1:5353", query("dropped.example.net.", dns.TypeA))
+	if response == nil || response.Rcode != dns.RcodeSuccess || len(response.Answer) != 0 {
+		t.Errorf("Expected an empty answer, got %v", response)
+	}
+	if app.Upstreams.(*testRecursor).calls != calls {
+		t.Error("Expected nothing to be looked up")
+	}
+}
+
+func TestCNAMELoop(t *testing.T) {
+	// The rule matches the name its own CNAME leads to.
+	ruled := newTestApp(t, `
+[[rule]]
+condition = "host endsWith '.example.com.' and answertype == 'A'"
+action = "cname many.example.com."
+`+largeZone, nil)
+	zoned := newTestApp(t, `
+[[zone]]
+origin = "example.com."
+TTL = 60
+    [zone.auth]
+    ns = "dns1.example.com"
+    email = "chris.example.com"
+    serial = 1
+    [[zone.record]]
+    host = "ping"
+    aliased = "pong"
+    [[zone.record]]
+    host = "pong"
+    aliased = "ping"
+`, nil)
+	for name, app := range map[string]*App{"many.example.com.": ruled, "ping.example.com.": zoned} {
+		response := ask(app, context.Background(), newTestWriter("tcp"), "127.0.0.1:5353", query(name, dns.TypeA))
+		if response == nil || response.Rcode != dns.RcodeServerFailure || len(response.Answer) != 0 {
+			t.Errorf("%s: expected the loop to fail, got %v", name, response)
+		}
+	}
+}
+
+func TestQueryPhaseRule(t *testing.T) {
+	recursor := &testRecursor{address: "192.0.2.10"}
+	app := newTestApp(t, `
+[[rule]]
+phase = "query"
+condition = "host endsWith '.ads.example.net.'"
+action = "rewrite 127.0.0.1"
+`, recursor)
+	response := ask(app, context.Background(), newTestWriter("udp"), "127.0.0.1:5353", query("banner.ads.example.net.", dns.TypeA))
+	if len(response.Answer) != 1 || response.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+		t.Errorf("Expected the rewritten address, got %v", response.Answer)
+	}
+	if recursor.calls != 0 {
+		t.Error("Expected nothing to be looked up")
+	}
+	response = ask(app, context.Background(), newTestWriter("udp"), "127.0.0.1:5353", query("www.example.net.", dns.TypeA))
+	if len(response.Answer) != 1 || recursor.calls != 1 {
+		t.Errorf("Expected other names to be looked up, got %v", response.Answer)
+	}
+}
+
+func TestAnswerPhaseRuleOnCachedAnswer(t *testing.T) {
+	recursor := &testRecursor{address: "192.0.2.10"}
+	app := newTestApp(t, `
+[settings]
+cache = true
+
+[[rule]]
+condition = "remoteip == '10.0.0.1' and answerip == '192.0.2.10'"
+action = "rewrite 192.0.2.99"
+`, recursor)
+	address := func(client string) string {
+		response := ask(app, context.Background(), newTestWriter("udp"), client, query("www.example.net.", dns.TypeA))
+		if len(response.Answer) != 1 {
+			t.Fatalf("Expected a single record, got %v", response.Answer)
+		}
+		return response.Answer[0].(*dns.A).A.String()
+	}
+	if ip := address("127.0.0.1:5353"); ip != "192.0.2.10" {
+		t.Errorf("Expected the upstream's answer, got %s", ip)
+	}
+	// From the cache, filtered all the same
+	if ip := address("10.0.0.1:5353"); ip != "192.0.2.99" {
+		t.Errorf("Expected the cached answer to be rewritten, got %s", ip)
+	}
+	// The cache holds what the upstream said.
+	if ip := address("127.0.0.1:5353"); ip != "192.0.2.10" {
+		t.Errorf("Expected the upstream's answer, got %s", ip)
+	}
+	if recursor.calls != 1 {
+		t.Errorf("Expected a single lookup, got %d", recursor.calls)
+	}
+}
@@ -0,0 +1,105 @@
+package iterative
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The infrastructure cache remembers where zones are delegated, and how to
+// reach their name servers, so that we do not start from the root every time.
+type infraCache struct {
+	sync.RWMutex
+	zones     map[string]delegation
+	addresses map[string]addresses
+}
+
+type delegation struct {
+	servers []string
+	// Zero for entries that never expire, such as the root hints.
+	expire time.Time
+}
+
+type addresses struct {
+	ips    []string
+	expire time.Time
+}
+
+func newInfraCache() *infraCache {
+	return &infraCache{
+		zones:     make(map[string]delegation),
+		addresses: make(map[string]addresses),
+	}
+}
+
+func alive(expire time.Time) bool {
+	return expire.IsZero() || time.Now().Before(expire)
+}
+
+func expiry(ttl uint32) time.Time {
+	if ttl == 0 {
+		ttl = 1
+	}
+	return time.Now().Add(time.Duration(ttl) * time.Second)
+}
+
+func (c *infraCache) setDelegation(zone string, servers []string, expire time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	c.zones[strings.ToLower(zone)] = delegation{servers: servers, expire: expire}
+}
+
+func (c *infraCache) setAddresses(name string, ips []string, expire time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	name = strings.ToLower(name)
+	if existing, ok := c.addresses[name]; ok && alive(existing.expire) {
+		// Merge IPv4 and IPv6 glue learnt separately.
+		for _, ip := range existing.ips {
+			if !contains(ips, ip) {
+				ips = append(ips, ip)
+			}
+		}
+		if !existing.expire.IsZero() && (expire.IsZero() || existing.expire.Before(expire)) {
+			expire = existing.expire
+		}
+	}
+	c.addresses[name] = addresses{ips: ips, expire: expire}
+}
+
+func (c *infraCache) getAddresses(name string) []string {
+	c.RLock()
+	defer c.RUnlock()
+	if entry, ok := c.addresses[strings.ToLower(name)]; ok && alive(entry.expire) {
+		return entry.ips
+	}
+	return nil
+}
+
+// closest returns the deepest zone we know the servers of, that name belongs to.
+func (c *infraCache) closest(name string) (string, []string) {
+	c.RLock()
+	defer c.RUnlock()
+	name = strings.ToLower(dns.Fqdn(name))
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		zone := name[off:]
+		if entry, ok := c.zones[zone]; ok && alive(entry.expire) {
+			return zone, entry.servers
+		}
+	}
+	if entry, ok := c.zones["."]; ok {
+		return ".", entry.servers
+	}
+	return ".", nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,343 @@
+package iterative
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Referrals followed for a single name before giving up.
+	maxReferrals = 30
+	// Length of the CNAME chains we are willing to chase.
+	maxCNAMEs = 8
+	// Nested lookups, when looking up the address of a name server itself
+	// requires a lookup...
+	maxDepth = 6
+
+	queryTimeout = 1500 * time.Millisecond
+	udpSize      = 1232
+)
+
+var (
+	ErrTooManyReferrals = errors.New("too many referrals")
+	ErrTooDeep          = errors.New("too many nested lookups")
+	ErrNoServer         = errors.New("no name server could be reached")
+)
+
+// Resolver answers any question by itself, starting from the root servers
+// and following referrals down to the servers authoritative for the name.
+type Resolver struct {
+	infra *infraCache
+	// Port the name servers listen on. Everybody uses 53, except our tests.
+	port    string
+	timeout time.Duration
+}
+
+// New reads the root servers, and their addresses, from a root hints file,
+// such as https://www.internic.net/domain/named.root
+func New(hintsPath string) (*Resolver, error) {
+	file, err := os.Open(hintsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	resolver := &Resolver{infra: newInfraCache(), port: "53", timeout: queryTimeout}
+	roots := []string{}
+	zp := dns.NewZoneParser(file, ".", hintsPath)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr := rr.(type) {
+		case *dns.NS:
+			if rr.Hdr.Name == "." {
+				roots = append(roots, strings.ToLower(rr.Ns))
+			}
+		case *dns.A:
+			resolver.infra.setAddresses(rr.Hdr.Name, []string{rr.A.String()}, time.Time{})
+		case *dns.AAAA:
+			resolver.infra.setAddresses(rr.Hdr.Name, []string{rr.AAAA.String()}, time.Time{})
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("no root server found in %s", hintsPath)
+	}
+	resolver.infra.setDelegation(".", roots, time.Time{})
+	return resolver, nil
+}
+
+// Exchange resolves the question in m and returns an answer ready to be
+// trimmed and relayed, along with the server that provided the final answer.
+func (r *Resolver) Exchange(m *dns.Msg) (*dns.Msg, string, error) {
+	if len(m.Question) != 1 {
+		return nil, "", errors.New("expected a single question")
+	}
+	q := m.Question[0]
+	chain, final, server, err := r.resolve(q.Name, q.Qtype, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	reply := new(dns.Msg)
+	reply.SetReply(m)
+	reply.Rcode = final.Rcode
+	reply.Answer = chain
+	reply.Ns = final.Ns
+	for _, rr := range final.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			reply.Extra = append(reply.Extra, rr)
+		}
+	}
+	return reply, server, nil
+}
+
+// resolve finds the records of type qtype for name, chasing CNAMEs along the
+// way. It returns the records found, and the last response received.
+func (r *Resolver) resolve(name string, qtype uint16, depth int) ([]dns.RR, *dns.Msg, string, error) {
+	if depth > maxDepth {
+		return nil, nil, "", ErrTooDeep
+	}
+	chain := []dns.RR{}
+	for cnames := 0; cnames <= maxCNAMEs; cnames++ {
+		response, zone, server, err := r.lookup(name, qtype, depth)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		records, next := follow(response.Answer, name, qtype, zone)
+		chain = append(chain, records...)
+		// The response code is about the last name the server could answer for:
+		// it tells nothing of a target outside of its zone.
+		if next == "" || response.Rcode != dns.RcodeSuccess && dns.IsSubDomain(zone, next) {
+			return chain, response, server, nil
+		}
+		name = next
+	}
+	return nil, nil, "", fmt.Errorf("CNAME chain longer than %d", maxCNAMEs)
+}
+
+// follow picks, among answers, the records owned by name, following any CNAME
+// chain the server already resolved for us. If the chain leads out of what
+// the server answered, the next name to look up is returned.
+// Only records in the server's zone are believed: anything else it answers
+// could poison our cache, and is looked up again from its own servers.
+func follow(answers []dns.RR, name string, qtype uint16, zone string) ([]dns.RR, string) {
+	records := []dns.RR{}
+	for hops := 0; hops <= maxCNAMEs; hops++ {
+		var cname *dns.CNAME
+		found := false
+		for _, rr := range answers {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			if rr.Header().Rrtype == qtype || qtype == dns.TypeANY {
+				records = append(records, rr)
+				found = true
+			} else if alias, ok := rr.(*dns.CNAME); ok && cname == nil {
+				cname = alias
+			}
+		}
+		if found || cname == nil {
+			return records, ""
+		}
+		records = append(records, cname)
+		name = cname.Target
+		if !dns.IsSubDomain(zone, name) || !inAnswers(answers, name) {
+			return records, name
+		}
+	}
+	return records, ""
+}
+
+func inAnswers(answers []dns.RR, name string) bool {
+	for _, rr := range answers {
+		if strings.EqualFold(rr.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup walks down the tree, from the closest zone we already know the
+// servers of, to the servers that are authoritative for name.
+// The walk uses QNAME minimisation (RFC 9156): each server is only told about
+// the next label, not the full name. The zone the answer comes from is
+// returned along with it.
+func (r *Resolver) lookup(name string, qtype uint16, depth int) (*dns.Msg, string, string, error) {
+	zone, servers := r.infra.closest(name)
+	extra := 1
+	for referrals := 0; referrals < maxReferrals; referrals++ {
+		qname := descend(name, zone, extra)
+		minimised := len(qname) < len(name)
+		qt := qtype
+		if minimised {
+			qt = dns.TypeA
+		}
+
+		response, server, err := r.ask(zone, servers, qname, qt, depth)
+		if err != nil {
+			return nil, "", "", err
+		}
+
+		if cut, nameservers := r.referral(response, zone, qname); cut != "" {
+			zone, servers = cut, nameservers
+			extra = 1
+			continue
+		}
+		if !minimised {
+			return response, zone, server, nil
+		}
+		switch response.Rcode {
+		case dns.RcodeSuccess:
+			// Still inside the same zone: reveal one more label.
+			extra++
+		case dns.RcodeNameError:
+			// RFC 8020: there is nothing below a name that does not exist.
+			return response, zone, server, nil
+		default:
+			// Some servers do not cope with minimised queries: ask the full question.
+			extra = dns.CountLabel(name)
+		}
+	}
+	return nil, "", "", ErrTooManyReferrals
+}
+
+// descend returns the ancestor of name that is extra labels below zone.
+func descend(name string, zone string, extra int) string {
+	total := dns.CountLabel(name)
+	want := dns.CountLabel(zone) + extra
+	if want >= total {
+		return name
+	}
+	indexes := dns.Split(name)
+	return name[indexes[total-want]:]
+}
+
+// referral recognizes a delegation to a child zone, and remembers its servers
+// and their glue.
+func (r *Resolver) referral(response *dns.Msg, zone string, qname string) (string, []string) {
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) > 0 {
+		return "", nil
+	}
+	cut := ""
+	nameservers := []string{}
+	var ttl uint32
+	for _, rr := range response.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := strings.ToLower(ns.Hdr.Name)
+		// Servers for zone can only delegate to zones between theirs and the name
+		// we asked about. Anything else is, at best, unhelpful.
+		if strings.EqualFold(owner, zone) || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, qname) {
+			continue
+		}
+		if cut != "" && cut != owner {
+			continue
+		}
+		cut = owner
+		nameservers = append(nameservers, strings.ToLower(ns.Ns))
+		if ttl == 0 || ns.Hdr.Ttl < ttl {
+			ttl = ns.Hdr.Ttl
+		}
+	}
+	if cut == "" {
+		return "", nil
+	}
+	r.infra.setDelegation(cut, nameservers, expiry(ttl))
+
+	glue := map[string][]string{}
+	for _, rr := range response.Extra {
+		owner := strings.ToLower(rr.Header().Name)
+		if !contains(nameservers, owner) || !dns.IsSubDomain(zone, owner) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			glue[owner] = append(glue[owner], rr.A.String())
+		case *dns.AAAA:
+			glue[owner] = append(glue[owner], rr.AAAA.String())
+		}
+	}
+	for owner, ips := range glue {
+		r.infra.setAddresses(owner, ips, expiry(ttl))
+	}
+	return cut, nameservers
+}
+
+// ask sends the question to the servers of zone, until one gives a usable answer.
+func (r *Resolver) ask(zone string, servers []string, qname string, qtype uint16, depth int) (*dns.Msg, string, error) {
+	// Servers we have an address for come first: looking up the others is costly.
+	ordered := []string{}
+	glueless := []string{}
+	for _, server := range servers {
+		if len(r.infra.getAddresses(server)) > 0 {
+			ordered = append(ordered, server)
+		} else {
+			glueless = append(glueless, server)
+		}
+	}
+	ordered = append(ordered, glueless...)
+
+	lastErr := ErrNoServer
+	for _, server := range ordered {
+		ips := r.infra.getAddresses(server)
+		if len(ips) == 0 {
+			if dns.IsSubDomain(zone, server) {
+				// Without glue, finding this one would take us back here.
+				continue
+			}
+			chain, _, _, err := r.resolve(server, dns.TypeA, depth+1)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			var ttl uint32
+			for _, rr := range chain {
+				if a, ok := rr.(*dns.A); ok {
+					ips = append(ips, a.A.String())
+					ttl = a.Hdr.Ttl
+				}
+			}
+			if len(ips) == 0 {
+				continue
+			}
+			r.infra.setAddresses(server, ips, expiry(ttl))
+		}
+		for _, ip := range ips {
+			address := net.JoinHostPort(ip, r.port)
+			response, err := r.query(address, qname, qtype)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+				lastErr = fmt.Errorf("%s answered %s", address, dns.RcodeToString[response.Rcode])
+				continue
+			}
+			return response, address, nil
+		}
+	}
+	return nil, "", lastErr
+}
+
+func (r *Resolver) query(address string, qname string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(qname, qtype)
+	m.RecursionDesired = false
+	m.SetEdns0(udpSize, false)
+
+	client := &dns.Client{Net: "udp", Timeout: r.timeout}
+	response, _, err := client.Exchange(m, address)
+	if err == nil && response.Truncated {
+		client.Net = "tcp"
+		response, _, err = client.Exchange(m, address)
+	}
+	return response, err
+}
@@ -0,0 +1,290 @@
+package iterative
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// A fake name server: it knows a few records, and a few delegations.
+type fakeServer struct {
+	sync.Mutex
+	records     []dns.RR
+	delegations map[string][]dns.RR
+	glue        []dns.RR
+	// Records slipped into the answers for a name, whatever they are
+	forged map[string][]dns.RR
+	asked  []string
+}
+
+func newFakeServer(records []string, delegations map[string][]string, glue []string) *fakeServer {
+	f := &fakeServer{delegations: map[string][]dns.RR{}}
+	for _, text := range records {
+		f.records = append(f.records, mustRR(text))
+	}
+	for zone, nss := range delegations {
+		for _, text := range nss {
+			f.delegations[zone] = append(f.delegations[zone], mustRR(text))
+		}
+	}
+	for _, text := range glue {
+		f.glue = append(f.glue, mustRR(text))
+	}
+	return f
+}
+
+func mustRR(text string) dns.RR {
+	rr, err := dns.NewRR(text)
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+func (f *fakeServer) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+	f.Lock()
+	f.asked = append(f.asked, name)
+	f.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	for zone, nss := range f.delegations {
+		if dns.IsSubDomain(zone, name) {
+			m.Ns = nss
+			for _, rr := range f.glue {
+				for _, ns := range nss {
+					if strings.EqualFold(rr.Header().Name, ns.(*dns.NS).Ns) {
+						m.Extra = append(m.Extra, rr)
+					}
+				}
+			}
+			w.WriteMsg(m)
+			return
+		}
+	}
+	m.Authoritative = true
+	exists := false
+	for _, rr := range f.records {
+		owner := strings.ToLower(rr.Header().Name)
+		if owner == name && (rr.Header().Rrtype == q.Qtype || rr.Header().Rrtype == dns.TypeCNAME) {
+			m.Answer = append(m.Answer, rr)
+		}
+		if dns.IsSubDomain(name, owner) {
+			exists = true
+		}
+	}
+	if !exists {
+		m.Rcode = dns.RcodeNameError
+	}
+	f.Lock()
+	m.Answer = append(m.Answer, f.forged[name]...)
+	f.Unlock()
+	w.WriteMsg(m)
+}
+
+func (f *fakeServer) questions() []string {
+	f.Lock()
+	defer f.Unlock()
+	return append([]string{}, f.asked...)
+}
+
+// hierarchy starts a root server, a server for the com. and net. TLDs, and
+// a server authoritative for a few zones, all on the same port.
+func hierarchy(t *testing.T) (*Resolver, *fakeServer, *fakeServer, *fakeServer) {
+	root := newFakeServer(nil,
+		map[string][]string{
+			"com.": {"com. 3600 IN NS ns.tld-servers.com."},
+			"net.": {"net. 3600 IN NS ns.tld-servers.com."},
+		},
+		[]string{"ns.tld-servers.com. 3600 IN A 127.0.0.2"})
+	tld := newFakeServer(nil,
+		map[string][]string{
+			"example.com.":  {"example.com. 3600 IN NS ns1.example.com."},
+			"glueless.com.": {"glueless.com. 3600 IN NS ns.other.net."},
+			"other.net.":    {"other.net. 3600 IN NS ns.other.net."},
+		},
+		[]string{
+			"ns1.example.com. 3600 IN A 127.0.0.3",
+			"ns.other.net. 3600 IN A 127.0.0.3",
+		})
+	auth := newFakeServer([]string{
+		"www.example.com. 300 IN A 192.0.2.1",
+		"alias.example.com. 300 IN CNAME www.other.net.",
+		"deep.a.b.example.com. 300 IN A 192.0.2.4",
+		"ns1.example.com. 300 IN A 127.0.0.3",
+		"www.other.net. 300 IN A 192.0.2.2",
+		"ns.other.net. 300 IN A 127.0.0.3",
+		"host.glueless.com. 300 IN A 192.0.2.3",
+	}, nil, nil)
+
+	port := serve(t, map[string]dns.Handler{
+		"127.0.0.1": root,
+		"127.0.0.2": tld,
+		"127.0.0.3": auth,
+	})
+
+	hints := filepath.Join(t.TempDir(), "named.root")
+	err := os.WriteFile(hints, []byte(".  3600000  NS  a.root-servers.net.\na.root-servers.net.  3600000  A  127.0.0.1\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver, err := New(hints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver.port = port
+	return resolver, root, tld, auth
+}
+
+// serve starts the fake servers on a port that is free on all their addresses.
+func serve(t *testing.T, handlers map[string]dns.Handler) string {
+	for attempt := 0; attempt < 10; attempt++ {
+		first, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := strconv.Itoa(first.LocalAddr().(*net.UDPAddr).Port)
+		conns := map[string]net.PacketConn{"127.0.0.1": first}
+		ok := true
+		for ip := range handlers {
+			if ip == "127.0.0.1" {
+				continue
+			}
+			conn, err := net.ListenPacket("udp", net.JoinHostPort(ip, port))
+			if err != nil {
+				ok = false
+				break
+			}
+			conns[ip] = conn
+		}
+		if !ok {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			continue
+		}
+		for ip, conn := range conns {
+			server := &dns.Server{PacketConn: conn, Handler: handlers[ip]}
+			go server.ActivateAndServe()
+			t.Cleanup(func() { server.Shutdown() })
+		}
+		return port
+	}
+	t.Skip("Unable to find a port available on every loopback address")
+	return ""
+}
+
+func resolve(t *testing.T, resolver *Resolver, name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	response, _, err := resolver.Exchange(m)
+	if err != nil {
+		t.Fatalf("Resolving %s: %s", name, err)
+	}
+	return response
+}
+
+func TestReferrals(t *testing.T) {
+	resolver, root, tld, _ := hierarchy(t)
+
+	response := resolve(t, resolver, "www.example.com.", dns.TypeA)
+	if len(response.Answer) != 1 || response.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("Unexpected answer %v", response.Answer)
+	}
+
+	// QNAME minimisation: the root only learns about com., the TLD about example.com.
+	for _, asked := range root.questions() {
+		if asked != "com." {
+			t.Errorf("Root server was asked about %s", asked)
+		}
+	}
+	for _, asked := range tld.questions() {
+		if asked != "example.com." {
+			t.Errorf("TLD server was asked about %s", asked)
+		}
+	}
+
+	// The delegation is now cached.
+	rootQueries := len(root.questions())
+	resolve(t, resolver, "ns1.example.com.", dns.TypeA)
+	if len(root.questions()) != rootQueries {
+		t.Errorf("Expected the infrastructure cache to spare the root a query")
+	}
+}
+
+func TestCNAMEChase(t *testing.T) {
+	resolver, _, _, _ := hierarchy(t)
+
+	response := resolve(t, resolver, "alias.example.com.", dns.TypeA)
+	if len(response.Answer) != 2 {
+		t.Fatalf("Expected a CNAME and its target, got %v", response.Answer)
+	}
+	if response.Answer[0].Header().Rrtype != dns.TypeCNAME || response.Answer[1].(*dns.A).A.String() != "192.0.2.2" {
+		t.Errorf("Unexpected answer %v", response.Answer)
+	}
+}
+
+func TestOutOfZoneRecords(t *testing.T) {
+	resolver, _, _, auth := hierarchy(t)
+	auth.Lock()
+	auth.forged = map[string][]dns.RR{"alias.example.com.": {mustRR("www.other.net. 300 IN A 198.51.100.66")}}
+	auth.Unlock()
+
+	response := resolve(t, resolver, "alias.example.com.", dns.TypeA)
+	if len(response.Answer) != 2 || response.Answer[1].(*dns.A).A.String() != "192.0.2.2" {
+		t.Fatalf("Expected the target to be resolved from its own servers, got %v", response.Answer)
+	}
+	asked := false
+	for _, name := range auth.questions() {
+		asked = asked || name == "www.other.net."
+	}
+	if !asked {
+		t.Error("Expected www.other.net. to be looked up")
+	}
+}
+
+func TestGluelessDelegation(t *testing.T) {
+	resolver, _, _, _ := hierarchy(t)
+
+	response := resolve(t, resolver, "host.glueless.com.", dns.TypeA)
+	if len(response.Answer) != 1 || response.Answer[0].(*dns.A).A.String() != "192.0.2.3" {
+		t.Fatalf("Unexpected answer %v", response.Answer)
+	}
+}
+
+func TestEmptyNonTerminal(t *testing.T) {
+	resolver, _, _, auth := hierarchy(t)
+
+	response := resolve(t, resolver, "deep.a.b.example.com.", dns.TypeA)
+	if len(response.Answer) != 1 || response.Answer[0].(*dns.A).A.String() != "192.0.2.4" {
+		t.Fatalf("Unexpected answer %v", response.Answer)
+	}
+	expected := []string{"b.example.com.", "a.b.example.com.", "deep.a.b.example.com."}
+	asked := auth.questions()
+	if len(asked) != len(expected) {
+		t.Fatalf("Expected %v to be asked, got %v", expected, asked)
+	}
+	for idx := range expected {
+		if asked[idx] != expected[idx] {
+			t.Errorf("Expected %v to be asked, got %v", expected, asked)
+		}
+	}
+}
+
+func TestNameError(t *testing.T) {
+	resolver, _, _, _ := hierarchy(t)
+
+	response := resolve(t, resolver, "nothere.example.com.", dns.TypeA)
+	if response.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected NXDOMAIN, got %s", dns.RcodeToString[response.Rcode])
+	}
+}
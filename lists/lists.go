@@ -0,0 +1,244 @@
+// Package lists holds the named lists of networks and domains that rules,
+// and other subsystems, look values up in.
+package lists
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/fusion/kittendns/config"
+	"github.com/miekg/dns"
+)
+
+// List matches addresses against its networks, and names against its
+// domains.
+type List struct {
+	sync.RWMutex
+	Name       string
+	definition config.List
+	networks   *networkTree
+	domains    *Domains
+	size       int
+}
+
+// Lists are looked up by name.
+type Lists struct {
+	lists   map[string]*List
+	watcher *fsnotify.Watcher
+}
+
+// New builds the lists, reading their files. They do not follow changes to
+// these files until Watch is called.
+func New(definitions []config.List) (*Lists, error) {
+	lists := &Lists{lists: map[string]*List{}}
+	for _, definition := range definitions {
+		list := &List{Name: definition.Name, definition: definition}
+		if err := list.load(); err != nil {
+			return nil, fmt.Errorf("list %s: %s", definition.Name, err)
+		}
+		lists.lists[definition.Name] = list
+	}
+	return lists, nil
+}
+
+// Get returns the named list, nil if there is none.
+func (l *Lists) Get(name string) *List {
+	if l == nil {
+		return nil
+	}
+	return l.lists[name]
+}
+
+// Contains tells whether value, an address or a name, is in the named list.
+func (l *Lists) Contains(name string, value string) bool {
+	list := l.Get(name)
+	if list == nil {
+		return false
+	}
+	return list.Contains(value)
+}
+
+// Contains tells whether value, an address or a name, is in the list.
+func (list *List) Contains(value string) bool {
+	if ip := net.ParseIP(value); ip != nil {
+		return list.ContainsIP(ip)
+	}
+	return list.ContainsName(value)
+}
+
+// ContainsIP tells whether ip belongs to one of the list's networks.
+func (list *List) ContainsIP(ip net.IP) bool {
+	list.RLock()
+	defer list.RUnlock()
+	return list.networks.contains(ip)
+}
+
+// ContainsName tells whether name is one of the list's domains, or one of
+// their subdomains.
+func (list *List) ContainsName(name string) bool {
+	list.RLock()
+	defer list.RUnlock()
+	return list.domains.Contains(name)
+}
+
+// Len is the number of entries the list was built from.
+func (list *List) Len() int {
+	list.RLock()
+	defer list.RUnlock()
+	return list.size
+}
+
+// load (re)builds the list from its entries and file. The list is left as it
+// was if anything is wrong.
+func (list *List) load() error {
+	networks := &networkTree{}
+	domains := &Domains{}
+	size := 0
+	add := func(entry string) error {
+		if err := addEntry(networks, domains, entry); err != nil {
+			return err
+		}
+		size++
+		return nil
+	}
+	for _, entry := range list.definition.Entries {
+		if err := add(entry); err != nil {
+			return err
+		}
+	}
+	if list.definition.File != "" {
+		if err := ReadEntries(list.definition.File, add); err != nil {
+			return err
+		}
+	}
+	list.Lock()
+	defer list.Unlock()
+	list.networks = networks
+	list.domains = domains
+	list.size = size
+	return nil
+}
+
+func addEntry(networks *networkTree, domains *Domains, entry string) error {
+	if _, network, err := net.ParseCIDR(entry); err == nil {
+		networks.insert(network)
+		return nil
+	}
+	if ip := net.ParseIP(entry); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			bits = 8 * net.IPv4len
+		}
+		networks.insert(&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		return nil
+	}
+	// Wildcards make it clear that subdomains match, which they always do.
+	domain := strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+	if !ValidDomain(domain) {
+		return fmt.Errorf("bad entry '%s'", entry)
+	}
+	domains.Add(domain)
+	return nil
+}
+
+// ValidDomain accepts host names, and the underscores of service names.
+func ValidDomain(domain string) bool {
+	if _, ok := dns.IsDomainName(domain); !ok || domain == "" {
+		return false
+	}
+	for _, r := range domain {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadEntries hands every entry of a file to add, skipping blank lines,
+// comments and AdBlock cosmetic filters. A comment starts with a '#' at the
+// beginning of a line, or after a space: "example.com##.banner" is a
+// cosmetic filter, which hides part of a page, not a domain to block.
+func ReadEntries(path string, add func(string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		entry := strings.TrimSpace(stripComment(scanner.Text()))
+		if entry == "" || cosmetic(entry) {
+			continue
+		}
+		if err := add(entry); err != nil {
+			return fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// stripComment cuts line at the first '#' that starts it, or follows a space.
+func stripComment(line string) string {
+	for idx := 0; idx < len(line); idx++ {
+		if line[idx] == '#' && (idx == 0 || line[idx-1] == ' ' || line[idx-1] == '\t') {
+			return line[:idx]
+		}
+	}
+	return line
+}
+
+// cosmetic tells AdBlock and AdGuard element hiding, and scriptlet, rules
+// apart: "##", "#@#", "#?#", "#$#", "#%#" and their exceptions.
+func cosmetic(entry string) bool {
+	for _, separator := range []string{"##", "#@#", "#?#", "#@?#", "#$#", "#@$#", "#%#", "#@%#"} {
+		if strings.Contains(entry, separator) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads lists whenever their file changes, until Close is called.
+func (l *Lists) Watch() error {
+	byPath := map[string][]*List{}
+	for _, list := range l.lists {
+		if list.definition.File != "" {
+			path := filepath.Clean(list.definition.File)
+			byPath[path] = append(byPath[path], list)
+		}
+	}
+	paths := make([]string, 0, len(byPath))
+	for path := range byPath {
+		paths = append(paths, path)
+	}
+	watcher, err := WatchFiles(paths, func(path string) {
+		for _, list := range byPath[path] {
+			if err := list.load(); err != nil {
+				log.Printf("Warning: unable to reload list %s: %s\n", list.Name, err)
+				continue
+			}
+			log.Printf("List %s reloaded, %d entries.\n", list.Name, list.Len())
+		}
+	})
+	if err != nil {
+		return err
+	}
+	l.watcher = watcher
+	return nil
+}
+
+// Close stops following changes to files.
+func (l *Lists) Close() {
+	if l.watcher != nil {
+		l.watcher.Close()
+	}
+}
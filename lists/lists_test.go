@@ -0,0 +1,80 @@
+package lists
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fusion/kittendns/config"
+)
+
+func TestMatching(t *testing.T) {
+	lists, err := New([]config.List{{
+		Name: "mixed",
+		Entries: []string{
+			"10.0.0.0/8", "192.168.1.19", "2001:db8::/32",
+			"ads.example.com", "*.tracker.net.", "10.0.0.0/24",
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for value, expected := range map[string]bool{
+		"10.1.2.3":            true,
+		"11.0.0.1":            false,
+		"192.168.1.19":        true,
+		"192.168.1.20":        false,
+		"2001:db8::1":         true,
+		"2001:db9::1":         false,
+		"::ffff:10.0.0.1":     true,
+		"ads.example.com.":    true,
+		"x.ADS.example.com":   true,
+		"example.com.":        false,
+		"badads.example.com.": false,
+		"pixel.tracker.net.":  true,
+		"tracker.net":         true,
+		"net.":                false,
+	} {
+		if lists.Contains("mixed", value) != expected {
+			t.Errorf("Expected %s in list to be %v", value, expected)
+		}
+	}
+	if lists.Contains("unknown", "10.1.2.3") {
+		t.Error("Expected an unknown list to contain nothing")
+	}
+	if _, err := New([]config.List{{Name: "bad", Entries: []string{"not a domain"}}}); err == nil {
+		t.Error("Expected a bad entry to be rejected")
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocked.txt")
+	if err := os.WriteFile(path, []byte("# Blocked\nads.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lists, err := New([]config.List{{Name: "blocked", File: path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lists.Watch(); err != nil {
+		t.Fatal(err)
+	}
+	defer lists.Close()
+	if !lists.Contains("blocked", "ads.example.com.") || lists.Contains("blocked", "10.0.0.1") {
+		t.Fatal("Expected the file's entries only")
+	}
+	if err := os.WriteFile(path, []byte("10.0.0.0/8 # Internal\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !lists.Contains("blocked", "10.0.0.1") {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the list to be reloaded")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if lists.Contains("blocked", "ads.example.com.") {
+		t.Error("Expected removed entries to be forgotten")
+	}
+}
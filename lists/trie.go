@@ -0,0 +1,146 @@
+package lists
+
+import (
+	"net"
+	"strings"
+)
+
+// networkTree is a binary radix tree of network prefixes: looking an address
+// up costs at most one step per bit, however many networks there are.
+type networkTree struct {
+	v4 *bitNode
+	v6 *bitNode
+}
+
+type bitNode struct {
+	children [2]*bitNode
+	// A network ends here: every address below it matches.
+	leaf bool
+}
+
+func (t *networkTree) insert(network *net.IPNet) {
+	ip, root := t.root(network.IP, true)
+	ones, _ := network.Mask.Size()
+	node := *root
+	for bit := 0; bit < ones; bit++ {
+		if node.leaf {
+			// A larger network already covers this one.
+			return
+		}
+		branch := bitAt(ip, bit)
+		if node.children[branch] == nil {
+			node.children[branch] = &bitNode{}
+		}
+		node = node.children[branch]
+	}
+	node.leaf = true
+	// Smaller networks are now redundant.
+	node.children = [2]*bitNode{}
+}
+
+func (t *networkTree) contains(ip net.IP) bool {
+	ip, root := t.root(ip, false)
+	if root == nil {
+		return false
+	}
+	node := *root
+	for bit := 0; node != nil; bit++ {
+		if node.leaf {
+			return true
+		}
+		if bit == len(ip)*8 {
+			return false
+		}
+		node = node.children[bitAt(ip, bit)]
+	}
+	return false
+}
+
+// root returns the address in its shortest form, and the tree for its family.
+func (t *networkTree) root(ip net.IP, create bool) (net.IP, **bitNode) {
+	root := &t.v6
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+		root = &t.v4
+	}
+	if *root == nil {
+		if !create {
+			return ip, nil
+		}
+		*root = &bitNode{}
+	}
+	return ip, root
+}
+
+func bitAt(ip net.IP, bit int) int {
+	return int(ip[bit/8]>>(7-uint(bit%8))) & 1
+}
+
+// Domains is a trie of domains, keyed on their labels from the root down, so
+// that a name matches a domain and all of its subdomains. It is not safe for
+// concurrent updates.
+type Domains struct {
+	root labelNode
+}
+
+type labelNode struct {
+	children map[string]*labelNode
+	leaf     bool
+}
+
+// Add adds a domain, with or without its trailing dot.
+func (t *Domains) Add(domain string) {
+	node := &t.root
+	labels := splitLabels(domain)
+	for idx := len(labels) - 1; idx >= 0; idx-- {
+		if node.leaf {
+			return
+		}
+		if node.children == nil {
+			node.children = map[string]*labelNode{}
+		}
+		child, ok := node.children[labels[idx]]
+		if !ok {
+			child = &labelNode{}
+			node.children[labels[idx]] = child
+		}
+		node = child
+	}
+	node.leaf = true
+	node.children = nil
+}
+
+// Contains tells whether name is one of the domains, or one of their
+// subdomains.
+func (t *Domains) Contains(name string) bool {
+	_, ok := t.Match(name)
+	return ok
+}
+
+// Match returns the domain name belongs to, if any.
+func (t *Domains) Match(name string) (string, bool) {
+	node := &t.root
+	labels := splitLabels(name)
+	for idx := len(labels); ; idx-- {
+		if node.leaf {
+			return strings.Join(labels[idx:], "."), true
+		}
+		if idx == 0 {
+			return "", false
+		}
+		node = node.children[labels[idx-1]]
+		if node == nil {
+			return "", false
+		}
+	}
+}
+
+// splitLabels splits a name into lower case labels, with or without its
+// trailing dot.
+func splitLabels(name string) []string {
+	name = strings.Trim(strings.ToLower(name), ".")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
@@ -0,0 +1,63 @@
+package lists
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// WatchFiles calls reload with the path of every file that changes, once it
+// has settled, until the watcher is closed. Directories are watched rather
+// than files, as editors tend to replace files rather than write to them.
+// There is nothing to watch, and no watcher, if paths is empty.
+func WatchFiles(paths []string, reload func(path string)) (*fsnotify.Watcher, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	watched := map[string]bool{}
+	for _, path := range paths {
+		watched[filepath.Clean(path)] = true
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	for path := range watched {
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	go func() {
+		// Files are often written in several steps: let them settle.
+		pending := map[string]bool{}
+		settle := time.NewTimer(time.Hour)
+		settle.Stop()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				path := filepath.Clean(event.Name)
+				if watched[path] && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					pending[path] = true
+					settle.Reset(time.Second)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("Warning: watching files:", err)
+			case <-settle.C:
+				for path := range pending {
+					reload(path)
+				}
+				pending = map[string]bool{}
+			}
+		}
+	}()
+	return watcher, nil
+}
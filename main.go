@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
@@ -14,13 +15,21 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/antonmedv/expr"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/fsnotify/fsnotify"
+	"github.com/fusion/kittendns/blocklist"
 	"github.com/fusion/kittendns/builders"
 	"github.com/fusion/kittendns/cache"
 	"github.com/fusion/kittendns/config"
+	"github.com/fusion/kittendns/cookie"
+	"github.com/fusion/kittendns/iterative"
+	"github.com/fusion/kittendns/lists"
+	"github.com/fusion/kittendns/metrics"
 	"github.com/fusion/kittendns/plugins"
+	"github.com/fusion/kittendns/ratelimit"
+	"github.com/fusion/kittendns/rpz"
+	"github.com/fusion/kittendns/rules"
+	"github.com/fusion/kittendns/upstream"
 	"github.com/miekg/dns"
 )
 
@@ -33,61 +42,155 @@ type Resolver struct {
 	entries *map[uint16]map[string]ResolverEntry
 }
 type App struct {
-	Config      *config.Config
-	Plugins     *plugins.Plugins
-	Records     *map[uint16]map[string]config.Record
-	Mailers     *map[string][]config.Mailer
-	NameServers *map[string][]config.NameServer
-	Resolver    *Resolver
-	Cache       *cache.RcCache
+	Config    *config.Config
+	Plugins   *plugins.Plugins
+	Views     []*View
+	Cache     *cache.RcCache
+	Inflight  *upstream.Coalescer
+	Upstreams Recursor
+	Cookies   *cookie.Jar
+	RRL       *ratelimit.RRL
+	Limiter   *ratelimit.Limiter
+	Lists     *lists.Lists
+	Blocklist *blocklist.Blocklist
+	RPZ       *rpz.Policies
+}
+
+// Recursor finds the answers we are not authoritative for, either by asking
+// upstream servers or by resolving them ourselves.
+type Recursor interface {
+	Exchange(m *dns.Msg) (*dns.Msg, string, error)
+}
+
+type Forwarder struct {
+	Domain    string
+	Upstreams Recursor
 }
 
 func main() {
+	// The cache outlives configuration reloads: there is no reason to
+	// forget everything we learnt from our parent just because a zone changed.
+	rcCache := &cache.RcCache{}
+	// Same for our cookie secret: clients would otherwise have to start over
+	// after each reload.
+	jar, err := cookie.NewJar("", 0)
+	if err != nil {
+		log.Fatal(err)
+	}
 	for {
-		if err := singleLifeCycle(); err != nil {
+		if err := singleLifeCycle(rcCache, jar); err != nil {
 			return
 		}
 	}
 }
 
-func singleLifeCycle() error {
+func singleLifeCycle(rcCache *cache.RcCache, jar *cookie.Jar) error {
 	app := App{}
 
 	app.Config = config.GetConfig()
+	var err error
+	app.Lists, err = lists.New(app.Config.List)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := app.Lists.Watch(); err != nil {
+		log.Println("Warning: unable to watch list changes:", err)
+	}
+	defer app.Lists.Close()
+	app.Views = app.newViews()
+	for _, view := range app.Views {
+		defer view.Close()
+	}
+	app.Blocklist, err = blocklist.New(app.Config.Blocklist)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(app.Config.Blocklist) > 0 {
+		log.Printf("Blocklists loaded, %d domains.\n", app.Blocklist.Len())
+	}
+	if err := app.Blocklist.Watch(); err != nil {
+		log.Println("Warning: unable to watch blocklist changes:", err)
+	}
+	defer app.Blocklist.Close()
+	app.RPZ, err = rpz.New(app.Config.RPZ)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := app.RPZ.Watch(); err != nil {
+		log.Println("Warning: unable to watch response policy zone changes:", err)
+	}
+	defer app.RPZ.Close()
 	app.Plugins = plugins.Load(app.Config)
-	app.NameServers = flattenNameServers(app.Config)
-	app.Mailers = flattenMailers(app.Config)
-	app.Records = flattenRecords(app.Config)
-	app.Resolver = &Resolver{entries: &map[uint16]map[string]ResolverEntry{
-		dns.TypeA:     {},
-		dns.TypeAAAA:  {},
-		dns.TypeCNAME: {},
-		//dns.TypeNS: {},
-		//dns.TypePTR: {},
-		dns.TypeSOA: {},
-		dns.TypeSRV: {},
-		dns.TypeTXT: {},
-	}}
-	app.Cache = &cache.RcCache{}
-
-	// attach request handler func
-	dns.HandleFunc(".", app.handleDnsRequest)
+	app.Cache = rcCache
+	app.Cache.Lock()
+	app.Cache.MaxStale = time.Duration(app.Config.Settings.ServeStale) * time.Second
+	app.Cache.Unlock()
+	app.Inflight = &upstream.Coalescer{}
+	if len(app.Config.Settings.Parent.Upstream) > 0 {
+		pool, err := upstream.NewPool(app.Config.Settings.Parent)
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.Upstreams = pool
+		defer pool.Close()
+	} else if app.Config.Settings.RootHints != "" {
+		resolver, err := iterative.New(app.Config.Settings.RootHints)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("No parent defined, resolving from the root servers.")
+		app.Upstreams = resolver
+	}
+	if app.Config.Settings.Cookies.Enabled {
+		if err := jar.Configure(
+			app.Config.Settings.Cookies.Secret,
+			time.Duration(app.Config.Settings.Cookies.Rotation)*time.Hour); err != nil {
+			log.Fatal(err)
+		}
+		app.Cookies = jar
+	}
+	app.RRL = ratelimit.NewRRL(app.Config.Settings.RRL)
+	limiter, err := ratelimit.NewLimiter(app.Config.Settings.ClientLimit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.Limiter = limiter
+	metrics.Serve(app.Config.Settings.MetricsListener)
+	if app.Config.Settings.CacheFile != "" && app.Cache.Len() == 0 {
+		restored, err := app.Cache.Load(app.Config.Settings.CacheFile)
+		if err != nil && !os.IsNotExist(err) {
+			log.Println("Warning: unable to restore cache:", err)
+		} else if restored > 0 {
+			log.Printf("Restored %d cache entries.\n", restored)
+		}
+	}
 
-	listenIp, listenPort := findUsableNetTuple(app.Config.Settings.Listeners)
-	// start server
-	server_u := &dns.Server{Addr: listenIp + ":" + strconv.Itoa(listenPort), Net: "udp", MsgAcceptFunc: moreLenientAcceptFunc}
-	server_t := &dns.Server{Addr: listenIp + ":" + strconv.Itoa(listenPort), Net: "tcp", MsgAcceptFunc: moreLenientAcceptFunc}
-	if app.Config.Secret.Signature != "" {
-		server_u.TsigSecret = map[string]string{app.Config.Secret.Key: app.Config.Secret.Signature}
-		server_t.TsigSecret = map[string]string{app.Config.Secret.Key: app.Config.Secret.Signature}
+	// start servers, one pair per listener, each with its own policy
+	var servers []*dns.Server
+	if len(app.Config.Listener) == 0 {
+		listenIp, listenPort := findUsableNetTuple(app.Config.Settings.Listeners)
+		servers = app.newServers(listenIp+":"+strconv.Itoa(listenPort), app.handleDnsRequest)
+	}
+	for idx := range app.Config.Listener {
+		listener := &app.Config.Listener[idx]
+		servers = append(servers, app.newServers(listener.Address, func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+			app.handleDnsRequest(context.WithValue(ctx, "listener", listener), w, r)
+		})...)
+	}
+	for _, server := range servers {
+		go func(server *dns.Server) {
+			if err := server.ListenAndServe(); err != nil {
+				log.Printf("Unable to listen (%s/%s): %s\n", server.Addr, server.Net, err)
+			}
+		}(server)
+		// Let the next lifecycle have our addresses.
+		defer server.Shutdown()
 	}
-    log.Printf("Listening (%s:%d)\n", listenIp, listenPort)
-	go server_u.ListenAndServe()
-	go server_t.ListenAndServe()
 
 	// server lifecycle
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sig)
 
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -125,15 +228,38 @@ func singleLifeCycle() error {
 				return nil
 			}
 			log.Printf("Signal %s received, stopping.\n", received.String())
+			if app.Config.Settings.CacheFile != "" {
+				if err := app.Cache.Save(app.Config.Settings.CacheFile); err != nil {
+					log.Println("Warning: unable to save cache:", err)
+				}
+			}
 			return errors.New("Signal received.")
 		}
 	}
 }
 
+// newServers returns a UDP and a TCP server for address.
+func (app *App) newServers(address string, handler dns.HandlerFunc) []*dns.Server {
+	var servers []*dns.Server
+	for _, network := range []string{"udp", "tcp"} {
+		server := &dns.Server{Addr: address, Net: network, Handler: handler, MsgAcceptFunc: moreLenientAcceptFunc}
+		if app.Config.Secret.Signature != "" {
+			server.TsigSecret = map[string]string{app.Config.Secret.Key: app.Config.Secret.Signature}
+		}
+		servers = append(servers, server)
+	}
+	log.Printf("Listening (%s)\n", address)
+	return servers
+}
+
 const (
 	_QR = 1 << 15 // query/response (response=1)
 )
 
+// Largest UDP payload we are willing to send, unless configured otherwise.
+// This is the DNS Flag Day 2020 recommendation, which avoids IP fragmentation.
+const defaultMaxUDPSize = 1232
+
 func findUsableNetTuple(listeners []string) (string, int) {
 	interfaces, _ := net.Interfaces()
 	for _, iinterface := range interfaces {
@@ -197,9 +323,9 @@ func moreLenientAcceptFunc(dh dns.Header) dns.MsgAcceptAction {
 	return dns.MsgAccept
 }
 
-func flattenNameServers(cfg *config.Config) *map[string][]config.NameServer {
+func flattenNameServers(zones []config.Zone) *map[string][]config.NameServer {
 	nameservers := map[string][]config.NameServer{}
-	for _, zone := range cfg.Zone {
+	for _, zone := range zones {
 		if zone.NameServer != nil {
 			for _, nameserver := range zone.NameServer {
 				if nameserver.TTL == 0 {
@@ -222,9 +348,9 @@ func flattenNameServers(cfg *config.Config) *map[string][]config.NameServer {
 	return &nameservers
 }
 
-func flattenMailers(cfg *config.Config) *map[string][]config.Mailer {
+func flattenMailers(zones []config.Zone) *map[string][]config.Mailer {
 	mailers := map[string][]config.Mailer{}
-	for _, zone := range cfg.Zone {
+	for _, zone := range zones {
 		if zone.Mailer != nil {
 			zoneMailers := []config.Mailer{}
 			noMailer := false
@@ -253,7 +379,7 @@ func flattenMailers(cfg *config.Config) *map[string][]config.Mailer {
 	return &mailers
 }
 
-func flattenRecords(cfg *config.Config) *map[uint16]map[string]config.Record {
+func flattenRecords(zones []config.Zone, debugLevel uint8) *map[uint16]map[string]config.Record {
 	var noAuth config.Auth
 
 	records := map[uint16]map[string]config.Record{
@@ -266,7 +392,7 @@ func flattenRecords(cfg *config.Config) *map[uint16]map[string]config.Record {
 		dns.TypeSRV: {},
 		dns.TypeTXT: {},
 	}
-	for _, zone := range cfg.Zone {
+	for _, zone := range zones {
 		for _, record := range zone.Record {
 			if zone.Auth != noAuth {
 				record.Auth = config.Auth{
@@ -365,7 +491,7 @@ func flattenRecords(cfg *config.Config) *map[uint16]map[string]config.Record {
 			records[dns.TypeA][canonicalize(zone.Origin, record.Host)] = record
 		}
 	}
-	if cfg.Settings.DebugLevel > 2 {
+	if debugLevel > 2 {
 		spew.Dump(records)
 	}
 	return &records
@@ -414,6 +540,7 @@ func (app *App) handleDnsRequest(ctx context.Context, w dns.ResponseWriter, r *d
 	m.Compress = false
 	m.Authoritative = true
 
+	tsigKey := ""
 	for _, e := range r.Extra {
 		// Are you trying to escalate privilege, maybe?
 		if e.Header().Rrtype == dns.TypeTSIG {
@@ -423,29 +550,252 @@ func (app *App) handleDnsRequest(ctx context.Context, w dns.ResponseWriter, r *d
 				return
 			}
 			ctx = context.WithValue(ctx, "privileged", true)
+			tsigKey = strings.ToLower(e.Header().Name)
 		}
 	}
 
-	remoteip := ""
-	remoteAddr := ctx.Value("remoteaddr")
-	if remoteAddr != nil {
-		remoteip = strings.Split(remoteAddr.(string), ":")[0]
+	remoteAddr, _ := ctx.Value("remoteaddr").(string)
+	req, err := newRequest(remoteAddr, r, app.Config.Settings.ClientSubnet)
+	if err != nil {
+		log.Println(err)
+		m.Rcode = dns.RcodeFormatError
+		app.writeResponse(w, r, m, req)
+		return
+	}
+	if w.RemoteAddr() != nil {
+		req.Transport = w.RemoteAddr().Network()
+	}
+	// RFC 6891: we only speak EDNS version 0
+	if opt := r.IsEdns0(); opt != nil && opt.Version() != 0 {
+		m.Rcode = dns.RcodeBadVers
+		m.SetEdns0(app.maxUDPSize(), opt.Do())
+		app.writeResponse(w, r, m, req)
+		return
+	}
+	req.TsigKey = tsigKey
+	req.Listener, _ = ctx.Value("listener").(*config.Listener)
+	req.View = app.selectView(req)
+	if req.View == nil {
+		if app.Config.Settings.DebugLevel > 2 {
+			log.Println("No view for", req.RemoteIP)
+		}
+		m.Rcode = dns.RcodeRefused
+		req.extendedError(dns.ExtendedErrorCodeProhibited, "")
+		app.writeResponse(w, r, m, req)
+		return
+	}
+	m.RecursionAvailable = app.canRecurse(req) && app.recursionAllowed(req)
+	if !app.checkCookie(r, m, req) {
+		app.writeResponse(w, r, m, req)
+		return
+	}
+	if !app.limitClient(req) {
+		if app.Config.Settings.ClientLimit.Action == "drop" {
+			return
+		}
+		m.Rcode = dns.RcodeRefused
+		app.writeResponse(w, r, m, req)
+		return
 	}
 
 	switch r.Opcode {
 	case dns.OpcodeQuery:
-		app.parseQuery(ctx, remoteip, m)
+		app.parseQuery(ctx, req, m)
 	case dns.OpcodeUpdate:
 		m.Ns = r.Ns
-		app.parseUpdate(ctx, m)
+		app.parseUpdate(ctx, req, m)
+	}
+	if req.Drop {
+		return
+	}
+
+	app.writeResponse(w, r, m, req)
+}
+
+// checkCookie validates the client's DNS cookie, if any, and prepares ours.
+// It returns false if the query should not be answered any further.
+func (app *App) checkCookie(r *dns.Msg, m *dns.Msg, req *Request) bool {
+	opt := r.IsEdns0()
+	if app.Cookies == nil || opt == nil {
+		return true
+	}
+	var option *dns.EDNS0_COOKIE
+	for _, o := range opt.Option {
+		if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+			option = c
+			break
+		}
 	}
+	// The client's actual address: a client subnet would not do here.
+	status, reply := app.Cookies.Check(option, net.ParseIP(req.RemoteIP))
+	req.Cookie = reply
+	switch status {
+	case cookie.Malformed:
+		m.Rcode = dns.RcodeFormatError
+		return false
+	case cookie.Valid:
+		req.CookieVerified = true
+	case cookie.ClientOnly:
+		// Over TCP, the handshake already vouches for the client's address.
+		if app.Config.Settings.Cookies.Enforce && req.Transport == "udp" {
+			if app.Config.Settings.DebugLevel > 2 {
+				log.Println("Missing server cookie from", req.RemoteIP)
+			}
+			m.Rcode = dns.RcodeBadCookie
+			return false
+		}
+	}
+	return true
+}
 
+// limitClient tells whether the client is still within its query limit.
+func (app *App) limitClient(req *Request) bool {
+	if app.Limiter == nil {
+		return true
+	}
+	ip := net.ParseIP(req.RemoteIP)
+	if ip == nil || app.Limiter.Exempt(ip) {
+		return true
+	}
+	settings := app.Config.Settings.ClientLimit
+	identity, kind := req.RemoteIP, "ip"
+	switch settings.Identity {
+	case "prefix":
+		prefix4, prefix6 := int(settings.IPv4Prefix), int(settings.IPv6Prefix)
+		if prefix4 == 0 || prefix4 > 32 {
+			prefix4 = 24
+		}
+		if prefix6 == 0 || prefix6 > 128 {
+			prefix6 = 56
+		}
+		identity, kind = ratelimit.Network(ip, prefix4, prefix6), "prefix"
+	case "tsig":
+		if req.TsigKey != "" {
+			identity, kind = req.TsigKey, "tsig"
+		}
+	case "ecs":
+		// Only a trusted client may speak for a whole network: anybody else
+		// could dodge its limit by stating a new subnet with every query.
+		if req.SubnetTrusted {
+			identity, kind = req.ClientNet.String(), "ecs"
+		}
+	}
+	allowed, first := app.Limiter.Allow(identity)
+	if allowed {
+		return true
+	}
+	metrics.ClientLimited.Add(1)
+	metrics.ClientLimitedBy.Add(kind, 1)
+	if first {
+		log.Println("Client over its query limit:", identity)
+	}
+	return false
+}
+
+// limitResponse applies response rate limiting to UDP answers, the only ones
+// that may be sent to a spoofed address. It returns false if the answer
+// should be dropped; m may be emptied and truncated instead.
+func (app *App) limitResponse(m *dns.Msg, req *Request) bool {
+	if app.RRL == nil || req == nil || req.Transport != "udp" || req.CookieVerified {
+		return true
+	}
+	verdict := app.RRL.Check(net.ParseIP(req.RemoteIP), m)
+	if verdict == ratelimit.Allow {
+		return true
+	}
+	if app.Config.Settings.RRL.LogOnly {
+		log.Println("Would rate limit response to", req.RemoteIP, "for", m.Question)
+		return true
+	}
+	if app.Config.Settings.DebugLevel > 0 {
+		log.Println("Rate limiting response to", req.RemoteIP, "for", m.Question)
+	}
+	if verdict == ratelimit.Drop {
+		metrics.RRLDropped.Add(1)
+		return false
+	}
+	metrics.RRLSlipped.Add(1)
+	m.Truncated = true
+	m.Answer, m.Ns, m.Extra = nil, nil, nil
+	return true
+}
+
+// writeResponse makes sure that the answer fits in what the client can
+// receive: over UDP, that is 512 bytes, or the buffer size advertised in its
+// OPT record. Answers that do not fit are truncated, so that the client
+// knows to retry over TCP.
+func (app *App) writeResponse(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg, req *Request) {
+	if !app.limitResponse(m, req) {
+		return
+	}
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		if m.IsEdns0() == nil {
+			m.SetEdns0(app.maxUDPSize(), opt.Do())
+		}
+		// RFC 7871: a client subnet option is answered in kind, with the scope
+		// our answer is valid for.
+		if req != nil && req.Subnet != nil {
+			subnet := *req.Subnet
+			subnet.SourceScope = req.SubnetScope
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &subnet)
+		}
+		if app.wantsNSID(opt) {
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_NSID{
+				Code: dns.EDNS0NSID,
+				Nsid: hex.EncodeToString([]byte(app.Config.Settings.Identity.NSID)),
+			})
+		}
+		if req != nil && req.Cookie != nil {
+			m.IsEdns0().Option = append(m.IsEdns0().Option, req.Cookie)
+		}
+		if req != nil && !app.Config.Settings.ExtendedErrors.Disabled {
+			for _, ede := range req.Errors {
+				ede := *ede
+				if ede.ExtraText == "" {
+					ede.ExtraText = app.Config.Settings.ExtendedErrors.TextFor(ede.InfoCode)
+				}
+				m.IsEdns0().Option = append(m.IsEdns0().Option, &ede)
+			}
+		}
+		size = int(opt.UDPSize())
+		if size > int(app.maxUDPSize()) {
+			size = int(app.maxUDPSize())
+		}
+	}
+	if w.RemoteAddr() != nil && w.RemoteAddr().Network() == "udp" {
+		m.Truncate(size)
+	}
 	w.WriteMsg(m)
 }
 
-func (app *App) parseQuery(ctx context.Context, remoteip string, m *dns.Msg) {
+// RFC 5001: clients ask for our NSID with an empty NSID option.
+func (app *App) wantsNSID(opt *dns.OPT) bool {
+	if app.Config.Settings.Identity.NoNSID {
+		return false
+	}
+	for _, option := range opt.Option {
+		if option.Option() == dns.EDNS0NSID {
+			return true
+		}
+	}
+	return false
+}
+
+func (app *App) maxUDPSize() uint16 {
+	if app.Config.Settings.MaxUDPSize >= dns.MinMsgSize {
+		return app.Config.Settings.MaxUDPSize
+	}
+	return defaultMaxUDPSize
+}
+
+func (app *App) parseQuery(ctx context.Context, req *Request, m *dns.Msg) {
 	for _, q := range m.Question {
-		done, err := app.processPrePlugins(ctx, remoteip, m, &q)
+		if q.Qclass == dns.ClassCHAOS {
+			app.chaosSearch(m, q)
+			continue
+		}
+		done, err := app.processPrePlugins(ctx, req, m, &q)
 		if done {
 			continue
 		}
@@ -455,30 +805,132 @@ func (app *App) parseQuery(ctx context.Context, remoteip string, m *dns.Msg) {
 		// This variable will be set to true if this is something
 		// we can resolve locally.
 		authoritative := false
+		req.Zone = ""
 		lowerName := strings.ToLower(q.Name)
-		for _, zone := range app.Config.Zone {
+		for _, zone := range req.View.Definition.Zone {
 			if strings.HasSuffix(lowerName, zone.Origin) {
 				authoritative = true
+				req.Zone = zone.Origin
+				break
+			}
+		}
+		// Rules that need not wait for an answer save us from looking it up.
+		if !app.Config.Settings.DisableRuleEngine {
+			if rule := app.parseRules(req, rules.QueryPhase, q, nil); rule != nil {
+				rrs, settled := app.applyRule(req, m, q, rule, nil)
+				m.Answer = append(m.Answer, rrs...)
+				if settled {
+					if err = app.processPostPlugins(ctx, req, m, &q); err != nil {
+						break
+					}
+					continue
+				}
+			}
+		}
+		// Response policy zones only apply to what others are authoritative for.
+		req.Passthru = false
+		if !authoritative {
+			var hit *rpz.Hit
+			hit, req.PolicyZone = app.RPZ.CheckQuery(q.Name, net.ParseIP(req.RemoteIP))
+			if hit != nil && app.applyPolicy(req, m, q, hit) {
+				if err = app.processPostPlugins(ctx, req, m, &q); err != nil {
+					break
+				}
+				continue
+			}
+		}
+		if !req.Passthru && app.block(req, m, q) {
+			if err = app.processPostPlugins(ctx, req, m, &q); err != nil {
 				break
 			}
+			continue
 		}
 		if authoritative {
-			app.authoritativeSearch(ctx, remoteip, m, q)
+			app.authoritativeSearch(ctx, req, m, q)
+		} else if app.canRecurse(req) && (!m.RecursionDesired || !app.recursionAllowed(req)) {
+			// Not an open resolver
+			if app.Config.Settings.DebugLevel > 2 {
+				log.Println("Refusing recursion for", q.Name, "to", req.RemoteIP)
+			}
+			m.Rcode = dns.RcodeRefused
+			req.extendedError(dns.ExtendedErrorCodeProhibited, "")
 		} else {
-			// TODO Check if RecursionRequested
-			app.recursiveSearch(ctx, remoteip, m, q)
+			app.recursiveSearch(ctx, req, m, q, app.findRecursor(req, lowerName))
 		}
-		err = app.processPostPlugins(ctx, remoteip, m, &q)
+		err = app.processPostPlugins(ctx, req, m, &q)
 		if err != nil {
 			break
 		}
 	}
 }
 
-func (app *App) processPrePlugins(ctx context.Context, remoteip string, m *dns.Msg, q *dns.Question) (bool, error) {
+// chaosSearch answers the CHAOS class identity queries (RFC 4892), which tell
+// which instance of an anycast service answered.
+func (app *App) chaosSearch(m *dns.Msg, q dns.Question) {
+	identity := app.Config.Settings.Identity
+	var text string
+	switch strings.ToLower(q.Name) {
+	case "hostname.bind.", "id.server.":
+		text = identity.Hostname
+	case "version.bind.", "version.server.":
+		if identity.HideVersion {
+			m.Rcode = dns.RcodeRefused
+			return
+		}
+		text = identity.Version
+	default:
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+	if q.Qtype != dns.TypeTXT && q.Qtype != dns.TypeANY {
+		return
+	}
+	m.Answer = append(m.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0},
+		Txt: []string{text},
+	})
+}
+
+func (app *App) canRecurse(req *Request) bool {
+	return app.Upstreams != nil || len(req.View.Forwarders) > 0
+}
+
+// recursionAllowed tells whether the client may have us recurse for it,
+// according to the policy of its view, of the listener it came through, or
+// our own.
+func (app *App) recursionAllowed(req *Request) bool {
+	acl := app.Config.Settings.AllowRecursion
+	if req.Listener != nil {
+		if req.Listener.NoRecursion {
+			return false
+		}
+		if len(req.Listener.AllowRecursion) > 0 {
+			acl = req.Listener.AllowRecursion
+		}
+	}
+	if view := req.View.Definition; view.NoRecursion {
+		return false
+	} else if len(view.AllowRecursion) > 0 {
+		acl = view.AllowRecursion
+	}
+	return len(acl) == 0 || req.matchACL(acl)
+}
+
+// findRecursor returns the upstreams of the most specific forwarding
+// definition for name, in the client's view, or our default recursor.
+func (app *App) findRecursor(req *Request, name string) Recursor {
+	for _, forwarder := range req.View.Forwarders {
+		if name == forwarder.Domain || strings.HasSuffix(name, "."+forwarder.Domain) {
+			return forwarder.Upstreams
+		}
+	}
+	return app.Upstreams
+}
+
+func (app *App) processPrePlugins(ctx context.Context, req *Request, m *dns.Msg, q *dns.Question) (bool, error) {
 	done := false
 	for _, plugin := range app.Plugins.PreHandler {
-		update, err := plugin.ProcessQuery(plugins.Pre, remoteip, m, q)
+		update, err := callPlugin(plugin, plugins.Pre, req, m, q)
 		if err != nil {
 			return false, err
 		}
@@ -486,6 +938,9 @@ func (app *App) processPrePlugins(ctx context.Context, remoteip string, m *dns.M
 			if update.Done {
 				done = true
 			}
+			if update.EDE != nil {
+				req.extendedError(update.EDE.InfoCode, update.EDE.ExtraText)
+			}
 			if update.Action == plugins.Reply {
 				m.Answer = append(m.Answer, update.RR...)
 			} else if update.Action == plugins.Question {
@@ -499,13 +954,16 @@ func (app *App) processPrePlugins(ctx context.Context, remoteip string, m *dns.M
 	return done, nil
 }
 
-func (app *App) processPostPlugins(ctx context.Context, remoteip string, m *dns.Msg, q *dns.Question) error {
+func (app *App) processPostPlugins(ctx context.Context, req *Request, m *dns.Msg, q *dns.Question) error {
 	for _, plugin := range app.Plugins.PostHandler {
-		update, err := plugin.ProcessQuery(plugins.Post, remoteip, m, q)
+		update, err := callPlugin(plugin, plugins.Post, req, m, q)
 		if err != nil {
 			return err
 		}
 		if update != nil {
+			if update.EDE != nil {
+				req.extendedError(update.EDE.InfoCode, update.EDE.ExtraText)
+			}
 			if update.Action == plugins.Reply {
 				m.Answer = append(m.Answer, update.RR...)
 			} else if update.Action == plugins.Rewrite {
@@ -519,13 +977,24 @@ func (app *App) processPostPlugins(ctx context.Context, remoteip string, m *dns.
 	return nil
 }
 
-func (app *App) parseUpdate(ctx context.Context, m *dns.Msg) {
+// callPlugin hands the query to a plugin, with as much detail as it can take.
+func callPlugin(plugin plugins.PreHandler, p plugins.PreOrPost, req *Request, m *dns.Msg, q *dns.Question) (*plugins.Update, error) {
+	if infoHandler, ok := plugin.(plugins.InfoHandler); ok {
+		return infoHandler.ProcessQueryInfo(p, &plugins.QueryInfo{
+			RemoteIp:  req.RemoteIP,
+			ClientNet: req.ClientNet,
+		}, m, q)
+	}
+	return plugin.ProcessQuery(p, req.RemoteIP, m, q)
+}
+
+func (app *App) parseUpdate(ctx context.Context, req *Request, m *dns.Msg) {
 	for _, n := range m.Ns {
-		app.authoritativeUpdate(ctx, m, n, m.Extra)
+		app.authoritativeUpdate(ctx, req, m, n, m.Extra)
 	}
 }
 
-func (app *App) authoritativeSearch(ctx context.Context, remoteip string, m *dns.Msg, q dns.Question) {
+func (app *App) authoritativeSearch(ctx context.Context, req *Request, m *dns.Msg, q dns.Question) {
 	var noAuth config.Auth
 
 	var answers []dns.RR
@@ -535,13 +1004,18 @@ func (app *App) authoritativeSearch(ctx context.Context, remoteip string, m *dns
 
 	lowerName := strings.ToLower(q.Name)
 
+	if q.Qtype == dns.TypeANY {
+		app.anySearch(ctx, req, m, q)
+		return
+	}
+
 	switch q.Qtype {
 
 	case dns.TypeSOA:
 		if app.Config.Settings.DebugLevel > 0 {
 			log.Printf("Zone SOA Query %s\n", q.Name)
 		}
-		for _, zone := range app.Config.Zone {
+		for _, zone := range req.View.Definition.Zone {
 			if zone.Origin == lowerName {
 				soaanswer := builders.NewSOA(zone.Origin, zone.Auth.Ns, zone.Auth.Email, zone.Auth.Serial)
 				answers = []dns.RR{soaanswer}
@@ -553,7 +1027,7 @@ func (app *App) authoritativeSearch(ctx context.Context, remoteip string, m *dns
 		if app.Config.Settings.DebugLevel > 0 {
 			log.Printf("SRV Query %s\n", q.Name)
 		}
-		record, ok := (*app.Records)[dns.TypeSRV][lowerName]
+		record, ok := (*req.View.Records)[dns.TypeSRV][lowerName]
 		if ok {
 			srv := builders.NewSRV(q.Name, record.Target, record.Port, record.Priority, record.Weight, record.TTL)
 			answers = []dns.RR{srv}
@@ -563,7 +1037,7 @@ func (app *App) authoritativeSearch(ctx context.Context, remoteip string, m *dns
 		if app.Config.Settings.DebugLevel > 0 {
 			log.Printf("TXT Query %s\n", q.Name)
 		}
-		record, ok := (*app.Records)[dns.TypeTXT][lowerName]
+		record, ok := (*req.View.Records)[dns.TypeTXT][lowerName]
 		if ok {
 			txt := builders.NewTXT(q.Name, record.Target, record.TTL)
 			answers = []dns.RR{txt}
@@ -573,7 +1047,7 @@ func (app *App) authoritativeSearch(ctx context.Context, remoteip string, m *dns
 		if app.Config.Settings.DebugLevel > 0 {
 			log.Printf("MX Query %s\n", q.Name)
 		}
-		mailers, ok := (*app.Mailers)[lowerName]
+		mailers, ok := (*req.View.Mailers)[lowerName]
 		if ok {
 			for _, mailer := range mailers {
 				mx := builders.NewMX(q.Name, mailer.Host, mailer.Priority, mailer.TTL)
@@ -585,7 +1059,7 @@ func (app *App) authoritativeSearch(ctx context.Context, remoteip string, m *dns
 		if app.Config.Settings.DebugLevel > 0 {
 			log.Printf("NS Query %s\n", q.Name)
 		}
-		nameservers, ok := (*app.NameServers)[lowerName]
+		nameservers, ok := (*req.View.NameServers)[lowerName]
 		if ok {
 			for _, nameserver := range nameservers {
 				ns := builders.NewNS(q.Name, nameserver.Host, nameserver.TTL)
@@ -594,14 +1068,14 @@ func (app *App) authoritativeSearch(ctx context.Context, remoteip string, m *dns
 		}
 
 	case dns.TypeAAAA, dns.TypeA, dns.TypeCNAME:
-		record, ok = (*app.Records)[dns.TypeA][lowerName]
+		record, ok = (*req.View.Records)[dns.TypeA][lowerName]
 		if !ok {
-			record, ok = (*app.Records)[dns.TypeCNAME][lowerName]
+			record, ok = (*req.View.Records)[dns.TypeCNAME][lowerName]
 		}
 		if !ok {
 			segments := strings.SplitN(lowerName, ".", 2)
 			if len(segments) == 2 {
-				record, ok = (*app.Records)[dns.TypeA][fmt.Sprintf("*.%s", segments[1])]
+				record, ok = (*req.View.Records)[dns.TypeA][fmt.Sprintf("*.%s", segments[1])]
 			}
 		}
 		if ok {
@@ -616,15 +1090,15 @@ func (app *App) authoritativeSearch(ctx context.Context, remoteip string, m *dns
 					log.Printf("Query for %s\n", q.Name)
 				}
 				if app.Config.Settings.LoadBalance {
-					app.Resolver.RWMutex.RLock()
-					resolver, ok := (*app.Resolver.entries)[record.Type][lowerName]
-					app.Resolver.RWMutex.RUnlock()
+					req.View.Resolver.RWMutex.RLock()
+					resolver, ok := (*req.View.Resolver.entries)[record.Type][lowerName]
+					req.View.Resolver.RWMutex.RUnlock()
 					if !ok {
-						app.Resolver.RWMutex.Lock()
-						(*app.Resolver.entries)[record.Type][lowerName] = ResolverEntry{
+						req.View.Resolver.RWMutex.Lock()
+						(*req.View.Resolver.entries)[record.Type][lowerName] = ResolverEntry{
 							NextIPv4: 0,
 							NextIPv6: 0}
-						app.Resolver.RWMutex.Unlock()
+						req.View.Resolver.RWMutex.Unlock()
 					}
 
 					var nextIP *uint8
@@ -642,12 +1116,12 @@ func (app *App) authoritativeSearch(ctx context.Context, remoteip string, m *dns
 						break
 					}
 
-					app.Resolver.RWMutex.Lock()
-					resolver = (*app.Resolver.entries)[record.Type][lowerName]
+					req.View.Resolver.RWMutex.Lock()
+					resolver = (*req.View.Resolver.entries)[record.Type][lowerName]
 					nextNextIP, ip := getNextIP(nextIP, recordIPs)
 					*nextIP = nextNextIP
-					(*app.Resolver.entries)[record.Type][lowerName] = resolver
-					app.Resolver.RWMutex.Unlock()
+					(*req.View.Resolver.entries)[record.Type][lowerName] = resolver
+					req.View.Resolver.RWMutex.Unlock()
 
 					rr, err := builders.NewRR(q.Qtype, q.Name, record.Host, ip, record.TTL)
 					if err == nil {
@@ -695,8 +1169,9 @@ func (app *App) authoritativeSearch(ctx context.Context, remoteip string, m *dns
 			if !app.Config.Settings.Lazy {
 				// If this is a CNAME, keep digging until we find an A record
 				if answer.Header().Rrtype == dns.TypeCNAME {
-					q.Name = answer.(*dns.CNAME).Target
-					app.authoritativeSearch(ctx, remoteip, m, q)
+					if !app.chase(ctx, req, m, q, answer.(*dns.CNAME).Target) {
+						return
+					}
 				}
 			}
 
@@ -708,44 +1183,138 @@ func (app *App) authoritativeSearch(ctx context.Context, remoteip string, m *dns
 	}
 
 	for _, answer := range answers {
-		action := app.parseRules(remoteip, lowerName, answer)
-		if action == "" {
+		rrs := []dns.RR{answer}
+		settled := false
+		if rule := app.parseRules(req, rules.AnswerPhase, q, answer); rule != nil {
+			rrs, settled = app.applyRule(req, m, q, rule, answer)
+		}
+		for _, rr := range rrs {
 			if app.Config.Settings.DebugLevel > 2 {
-				log.Println("Providing answer", answer)
+				log.Println("Providing answer", rr)
 			}
-			m.Answer = append(m.Answer, answer)
+			m.Answer = append(m.Answer, rr)
 
 			if !app.Config.Settings.Lazy {
 				// If this is a CNAME, keep digging until we find an A record
-				if answer.Header().Rrtype == dns.TypeCNAME {
-					q.Name = answer.(*dns.CNAME).Target
-					app.authoritativeSearch(ctx, remoteip, m, q)
+				if rr.Header().Rrtype == dns.TypeCNAME {
+					if !app.chase(ctx, req, m, q, rr.(*dns.CNAME).Target) {
+						return
+					}
 				}
 			}
 
 			if soa != noSoa {
 				m.Ns = []dns.RR{soa}
 			}
-			continue
 		}
-		if action == "drop" {
-			// Do nothing ... no response
-			continue
+		if settled {
+			return
 		}
-		if action == "inspect" {
-			spew.Dump(record)
-			continue
+	}
+}
+
+// How many CNAMEs we follow within our own zones, for a single question.
+const maxChase = 12
+
+// chase looks q up again under target, the CNAME it led to, and tells whether
+// the answer may go on. Names already followed, by our zones or by rules, make
+// for a loop, which is a server failure.
+func (app *App) chase(ctx context.Context, req *Request, m *dns.Msg, q dns.Question, target string) bool {
+	if req.Chased == nil {
+		req.Chased = map[string]bool{strings.ToLower(q.Name): true}
+	}
+	lowerTarget := strings.ToLower(target)
+	if req.Chased[lowerTarget] || len(req.Chased) > maxChase {
+		log.Printf("CNAME loop for %s at %s\n", q.Name, target)
+		m.Rcode = dns.RcodeServerFailure
+		m.Answer, m.Ns = nil, nil
+		req.extendedError(dns.ExtendedErrorCodeOther, "CNAME loop")
+		return false
+	}
+	req.Chased[lowerTarget] = true
+	q.Name = target
+	app.authoritativeSearch(ctx, req, m, q)
+	return m.Rcode != dns.RcodeServerFailure
+}
+
+// What we look for when asked for ANY, in order of preference.
+var anyTypes = []uint16{
+	dns.TypeA, dns.TypeAAAA, dns.TypeMX, dns.TypeTXT, dns.TypeSRV, dns.TypeNS, dns.TypeSOA,
+}
+
+// anySearch answers ANY queries with one RRset, unless the client may have
+// them all (RFC 8482).
+func (app *App) anySearch(ctx context.Context, req *Request, m *dns.Msg, q dns.Question) {
+	full := app.fullAny(ctx, req)
+	if !full && app.Config.Settings.Any.Policy == "hinfo" {
+		m.Answer = append(m.Answer, anyHINFO(q.Name))
+		return
+	}
+	seen := map[string]bool{}
+	for _, qtype := range anyTypes {
+		sub := new(dns.Msg)
+		subQ := q
+		subQ.Qtype = qtype
+		app.authoritativeSearch(ctx, req, sub, subQ)
+		for _, rr := range sub.Answer {
+			if !seen[rr.String()] {
+				seen[rr.String()] = true
+				m.Answer = append(m.Answer, rr)
+			}
 		}
-		if strings.HasPrefix(action, "rewrite ") {
-			shadowIP := unquote(strings.TrimPrefix(action, "rewrite "))
-			rr, _ := builders.NewRR(dns.TypeA, q.Name, q.Name, shadowIP, 3600) // TODO Fix TTL and type
-			m.Answer = append(m.Answer, rr)
-			continue
+		if len(sub.Ns) > 0 {
+			m.Ns = sub.Ns
+		}
+		if !full && len(m.Answer) > 0 {
+			return
+		}
+	}
+}
+
+// fullAny tells whether the client may receive every RRset for ANY: it is
+// then known not to be spoofing its address.
+func (app *App) fullAny(ctx context.Context, req *Request) bool {
+	settings := app.Config.Settings.Any
+	if settings.FullOverTCP && req.Transport == "tcp" {
+		return true
+	}
+	privileged, _ := ctx.Value("privileged").(bool)
+	return settings.FullWithTSIG && privileged
+}
+
+// minimalAny trims an upstream answer to ANY down to its first RRset, or to
+// our HINFO record.
+func (app *App) minimalAny(m *dns.Msg, q dns.Question) {
+	if len(m.Answer) == 0 {
+		return
+	}
+	if app.Config.Settings.Any.Policy == "hinfo" {
+		m.Answer = []dns.RR{anyHINFO(q.Name)}
+		return
+	}
+	first := m.Answer[0].Header().Rrtype
+	var answer []dns.RR
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype == first {
+			answer = append(answer, rr)
 		}
 	}
+	m.Answer = answer
 }
 
-func (app *App) authoritativeUpdate(ctx context.Context, m *dns.Msg, n dns.RR, extra []dns.RR) {
+// RFC 8482 section 4.2: the synthesized HINFO record is the same for every
+// name, and may be cached for a long time.
+const anyHINFOTTL = 3600
+
+func anyHINFO(name string) dns.RR {
+	return &dns.HINFO{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: anyHINFOTTL},
+		Cpu: "RFC8482",
+		Os:  "",
+	}
+}
+
+func (app *App) authoritativeUpdate(ctx context.Context, req *Request, m *dns.Msg, n dns.RR, extra []dns.RR) {
 	// TXT only for now!
 	// I could assume that the question section will always contain the SOA name.
 	// I have a strong feeling that this would be a mistake. Therefore I am going in a different direction.
@@ -768,7 +1337,7 @@ func (app *App) authoritativeUpdate(ctx context.Context, m *dns.Msg, n dns.RR, e
 			return
 		}
 
-		(*app.Records)[dns.TypeTXT][recordName] = config.Record{
+		(*req.View.Records)[dns.TypeTXT][recordName] = config.Record{
 			Type:   dns.TypeTXT,
 			Text:   recordName,
 			Target: recordTxt,
@@ -799,53 +1368,240 @@ func (app *App) authoritativeUpdate(ctx context.Context, m *dns.Msg, n dns.RR, e
 	*/
 }
 
-func (app *App) recursiveSearch(ctx context.Context, remoteip string, m *dns.Msg, q dns.Question) {
-	if app.Config.Settings.Parent.Address == "" {
+func (app *App) recursiveSearch(ctx context.Context, req *Request, m *dns.Msg, q dns.Question, recursor Recursor) {
+	if recursor == nil {
 		if app.Config.Settings.DebugLevel > 2 {
 			log.Println("Not recursing as no parent was defined.")
 		}
+		req.extendedError(dns.ExtendedErrorCodeNotAuthoritative, "")
 		return
 
 	}
 
 	lowerName := strings.ToLower(q.Name)
+	// A view's own forwarders may well tell a different story: their answers
+	// are cached for that view only.
+	cacheName := lowerName
+	if recursor != app.Upstreams && len(app.Views) > 1 {
+		cacheName = req.View.Name() + "|" + lowerName
+	}
 
-	answers, ok, remaining := app.Cache.Get(lowerName)
+	var clientIP net.IP
+	if req.ClientNet != nil {
+		clientIP = req.ClientNet.IP
+	}
+	entry, ok, remaining := app.Cache.Get(cacheName, q.Qtype, clientIP)
 	if ok {
 		if app.Config.Settings.DebugLevel > 2 {
 			log.Println("Cache hit for", q.Name, "remaining", remaining, "seconds")
 		}
-		m.Answer = answers
-	} else {
+		req.SubnetScope = entry.ScopePrefix
+		relay(m, q, entry.Rcode, entry.Targets, entry.Ns, entry.Extra)
+		app.relayed(ctx, req, m, q)
+		return
+	}
+
+	// Only tell our parents as much about the client as we are allowed to.
+	subnet := req.upstreamSubnet(app.Config.Settings.ClientSubnet)
+	key := upstream.Key(q)
+	if cacheName != lowerName {
+		key = req.View.Name() + "|" + key
+	}
+	if subnet != nil {
+		key = fmt.Sprintf("%s@%s/%d", key, subnet.Address, subnet.SourceNetmask)
+	}
+
+	// Everyone asking the same question at the same time shares a single
+	// trip to the parent.
+	response, shared, err := app.Inflight.Do(key, func() (*dns.Msg, error) {
 		recM := new(dns.Msg)
 		recM.Id = dns.Id()
 		recM.RecursionDesired = true
 		recM.Question = []dns.Question{q}
-		client := new(dns.Client)
-		if app.Config.Settings.DebugLevel > 0 {
-			log.Println("Recursing to", app.Config.Settings.Parent.Address)
+		if subnet != nil {
+			recM.SetEdns0(defaultMaxUDPSize, false)
+			opt := recM.IsEdns0()
+			opt.Option = append(opt.Option, subnet)
 		}
-		response, _, err := client.Exchange(recM, app.Config.Settings.Parent.Address)
+		response, parent, err := recursor.Exchange(recM)
 		if err != nil {
+			return nil, err
+		}
+		if app.Config.Settings.DebugLevel > 0 {
+			log.Println("Recursed to", parent)
+		}
+		if ttl, ok := cacheTTL(response); ok {
+			app.Cache.Set(
+				cache.Flatten,
+				cacheName,
+				q.Qtype,
+				response,
+				ttl,
+				answerScope(response, subnet))
+		}
+		return response, nil
+	})
+	if err != nil {
+		// Fail fast, without complaining on every query, while circuits are open.
+		if err != upstream.ErrCircuitOpen || app.Config.Settings.DebugLevel > 0 {
 			log.Println(err)
+		}
+		if stale, ok := app.Cache.GetStale(cacheName, q.Qtype, clientIP); ok {
+			metrics.StaleAnswers.Add(1)
+			req.SubnetScope = stale.ScopePrefix
+			req.extendedError(dns.ExtendedErrorCodeStaleAnswer, "")
+			relay(m, q, stale.Rcode, stale.Targets, stale.Ns, stale.Extra)
+			app.relayed(ctx, req, m, q)
+			return
+		}
+		m.Rcode = dns.RcodeServerFailure
+		req.extendedError(dns.ExtendedErrorCodeNetworkError, "")
+		return
+	}
+	if shared && app.Config.Settings.DebugLevel > 2 {
+		log.Println("Shared in-flight answer for", q.Name)
+	}
+	if scope := answerScope(response, subnet); scope != nil {
+		ones, _ := scope.Mask.Size()
+		req.SubnetScope = uint8(ones)
+	}
+	// Pass on whatever our parent had to say about its answer.
+	if opt := response.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if ede, ok := option.(*dns.EDNS0_EDE); ok {
+				req.extendedError(ede.InfoCode, ede.ExtraText)
+			}
+		}
+	}
+	relay(m, q, response.Rcode, response.Answer, response.Ns, response.Extra)
+	app.relayed(ctx, req, m, q)
+}
+
+// relayed applies our policies to an answer that comes from elsewhere.
+func (app *App) relayed(ctx context.Context, req *Request, m *dns.Msg, q dns.Question) {
+	if q.Qtype == dns.TypeANY && !app.fullAny(ctx, req) {
+		app.minimalAny(m, q)
+	}
+	if !req.Passthru {
+		if hit := app.RPZ.CheckResponse(req.PolicyZone, q.Name, net.ParseIP(req.RemoteIP), m.Answer, m.Ns); hit != nil && app.applyPolicy(req, m, q, hit) {
 			return
 		}
+	}
+	app.filterAnswers(req, m, q)
+}
 
-		if len(response.Answer) < 1 {
-			log.Println("No answer")
+// filterAnswers runs the answer phase rules on every record we did not make
+// up ourselves: forwarded, or cached.
+func (app *App) filterAnswers(req *Request, m *dns.Msg, q dns.Question) {
+	if app.Config.Settings.DisableRuleEngine {
+		return
+	}
+	answers := m.Answer
+	m.Answer = nil
+	for _, answer := range answers {
+		rrs := []dns.RR{answer}
+		settled := false
+		if rule := app.parseRules(req, rules.AnswerPhase, q, answer); rule != nil {
+			rrs, settled = app.applyRule(req, m, q, rule, answer)
+		}
+		m.Answer = append(m.Answer, rrs...)
+		if settled {
 			return
 		}
-		app.Cache.Set(
-			cache.Flatten,
-			lowerName,
-			q.Qtype,
-			response.Answer,
-			uint32(response.Answer[0].Header().Ttl))
-		m.Answer = response.Answer
 	}
-	// Do not copy Ns as we cannot be authoritative
+}
+
+// answerScope returns the client network an upstream answer is valid for,
+// as stated by the scope of its client subnet option, or nil if the answer
+// is valid for everyone.
+func answerScope(response *dns.Msg, subnet *dns.EDNS0_SUBNET) *net.IPNet {
+	if subnet == nil {
+		return nil
+	}
+	opt := response.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		scoped, ok := option.(*dns.EDNS0_SUBNET)
+		if !ok || scoped.Family != subnet.Family || scoped.SourceScope == 0 {
+			continue
+		}
+		// RFC 7871 section 7.3.1: we cannot cache for a network narrower than
+		// the one we asked about.
+		ones := scoped.SourceScope
+		if ones > subnet.SourceNetmask {
+			ones = subnet.SourceNetmask
+		}
+		bits := 32
+		if subnet.Family == 2 {
+			bits = 128
+		}
+		mask := net.CIDRMask(int(ones), bits)
+		address := subnet.Address
+		if address4 := address.To4(); bits == 32 && address4 != nil {
+			address = address4
+		}
+		return &net.IPNet{IP: address.Mask(mask), Mask: mask}
+	}
+	return nil
+}
+
+// relay copies an upstream answer into our reply. OPT and TSIG records are
+// left behind: they only made sense between us and the upstream.
+func relay(m *dns.Msg, q dns.Question, rcode int, answer []dns.RR, ns []dns.RR, extra []dns.RR) {
+	// Not our data: we cannot claim to be authoritative
+	m.Authoritative = false
+	m.Rcode = rcode
+	m.Answer = withQueryCase(answer, q.Name)
+	m.Ns = ns
+	m.Extra = nil
+	for _, rr := range extra {
+		if rr.Header().Rrtype == dns.TypeOPT || rr.Header().Rrtype == dns.TypeTSIG {
+			continue
+		}
+		m.Extra = append(m.Extra, rr)
+	}
+}
+
+// cacheTTL tells for how long a response may be cached: for as long as its
+// shortest lived answer, or, for negative answers, as long as the zone's SOA
+// says (RFC 2308). Errors are not cached.
+func cacheTTL(response *dns.Msg) (uint32, bool) {
+	if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+		return 0, false
+	}
+	if response.Rcode == dns.RcodeSuccess && len(response.Answer) > 0 {
+		ttl := response.Answer[0].Header().Ttl
+		for _, rr := range response.Answer {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		return ttl, true
+	}
+	for _, rr := range response.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return ttl, true
+		}
+	}
+	return 0, false
+}
 
-	// TODO Implement rule engine knowing that all answers are within a single message
+// withQueryCase gives records owned by the queried name the exact casing used
+// in the question, as answers may have been obtained on behalf of another
+// client (0x20).
+func withQueryCase(rrs []dns.RR, name string) []dns.RR {
+	for _, rr := range rrs {
+		if rr.Header().Name != name && strings.EqualFold(rr.Header().Name, name) {
+			rr.Header().Name = name
+		}
+	}
+	return rrs
 }
 
 func getNextIP(idx *uint8, ips *[]string) (uint8, string) {
@@ -857,42 +1613,258 @@ func getNextIP(idx *uint8, ips *[]string) (uint8, string) {
 	return nextIdx, ip
 }
 
-func (app *App) parseRules(remoteip string, host string, answer dns.RR) string {
-	if app.Config.Settings.DebugLevel > 2 {
-		log.Printf("Parsing rules for host [%s], remoteip [%s]\n", host, remoteip)
+// TTL of the records made up by rules, when there is no answer to borrow it from
+const ruleTTL = 300
+
+// applyRule carries out the actions of a rule that matched answer. It returns
+// the records to answer with instead, and whether the answer is settled:
+// nothing else should be added to it.
+func (app *App) applyRule(req *Request, m *dns.Msg, q dns.Question, rule *rules.Rule, answer dns.RR) ([]dns.RR, bool) {
+	var rrs []dns.RR
+	ttl := uint32(ruleTTL)
+	if answer != nil {
+		rrs = []dns.RR{answer}
+		ttl = answer.Header().Ttl
+	}
+	overrideTTL := false
+	var terminal *rules.Action
+	for idx, action := range rule.Actions {
+		switch action.Name {
+		case "ttl":
+			ttl = action.TTL
+			overrideTTL = true
+		case "log":
+			log.Printf("Rule '%s' matched %s %s from %s\n", rule.Condition, q.Name, dns.TypeToString[q.Qtype], req.RemoteIP)
+		case "tag":
+			req.Tags = append(req.Tags, action.Args[0])
+		case "inspect":
+			log.Printf("Inspecting %s %s from %s: rule '%s' -> '%s'\n", q.Name, dns.TypeToString[q.Qtype], req.RemoteIP, rule.Condition, rule.Action)
+			spew.Dump(answer)
+		default:
+			terminal = &rule.Actions[idx]
+		}
 	}
 
-	env := map[string]interface{}{
-		"host":     host,
-		"remoteip": remoteip,
+	settled := false
+	if terminal != nil {
+		settled = true
+		switch terminal.Name {
+		case "nxdomain":
+			m.Rcode = dns.RcodeNameError
+			m.Answer, rrs = nil, nil
+			ruleError(req, rule.Rule, dns.ExtendedErrorCodeBlocked)
+		case "refuse":
+			m.Rcode = dns.RcodeRefused
+			m.Answer, rrs = nil, nil
+			ruleError(req, rule.Rule, dns.ExtendedErrorCodeProhibited)
+		case "servfail":
+			m.Rcode = dns.RcodeServerFailure
+			m.Answer, rrs = nil, nil
+			ruleError(req, rule.Rule, dns.ExtendedErrorCodeFiltered)
+		case "noerror-empty":
+			m.Answer, rrs = nil, nil
+			ruleError(req, rule.Rule, dns.ExtendedErrorCodeFiltered)
+		case "drop":
+			// The record goes, the rest of the answer stays. Before any answer,
+			// there is nothing to look up.
+			rrs = nil
+			settled = answer == nil
+			ruleError(req, rule.Rule, dns.ExtendedErrorCodeFiltered)
+		case "noresponse":
+			req.Drop = true
+			rrs = nil
+			ruleError(req, rule.Rule, dns.ExtendedErrorCodeFiltered)
+		case "rewrite":
+			// Only the addresses that fit the question
+			rrs = nil
+			for _, ip := range terminal.Args {
+				isV4 := net.ParseIP(ip).To4() != nil
+				if !(q.Qtype == dns.TypeA && isV4) && !(q.Qtype == dns.TypeAAAA && !isV4) {
+					continue
+				}
+				if rr, err := builders.NewRR(q.Qtype, q.Name, q.Name, ip, ttl); err == nil {
+					rrs = append(rrs, rr)
+				}
+			}
+			ruleError(req, rule.Rule, dns.ExtendedErrorCodeForgedAnswer)
+		case "cname":
+			rrs = []dns.RR{builders.NewCNAME(q.Name, dns.Fqdn(terminal.Args[0]), ttl)}
+			ruleError(req, rule.Rule, dns.ExtendedErrorCodeForgedAnswer)
+		}
 	}
-	for _, rule := range app.Config.Rule {
-		out, err := expr.Eval(rule.Condition, env)
-		if err != nil {
-			log.Println("Bad rule", err)
-			continue
+	if overrideTTL {
+		for idx, rr := range rrs {
+			rr = dns.Copy(rr)
+			rr.Header().Ttl = ttl
+			rrs[idx] = rr
 		}
-		if out == false {
-			continue
+	}
+	return rrs, settled
+}
+
+// block answers q if its name is blocklisted, as configured, and tells
+// whether it did.
+func (app *App) block(req *Request, m *dns.Msg, q dns.Question) bool {
+	reason, blocked := app.Blocklist.Check(q.Name)
+	if !blocked {
+		return false
+	}
+	metrics.Blocked.Add(1)
+	if !app.Config.Settings.Blocking.NoLog {
+		log.Printf("Blocked %s %s from %s: %s\n", q.Name, dns.TypeToString[q.Qtype], req.RemoteIP, reason)
+	}
+	blocking := app.Config.Settings.Blocking
+	switch blocking.Response {
+	case "nxdomain":
+		m.Rcode = dns.RcodeNameError
+	case "refuse":
+		m.Rcode = dns.RcodeRefused
+	case "null", "sinkhole":
+		// Other types get an empty answer.
+		ip := ""
+		switch {
+		case q.Qtype == dns.TypeA && blocking.Response == "null":
+			ip = "0.0.0.0"
+		case q.Qtype == dns.TypeAAAA && blocking.Response == "null":
+			ip = "::"
+		case q.Qtype == dns.TypeA:
+			ip = blocking.SinkholeIPv4
+		case q.Qtype == dns.TypeAAAA:
+			ip = blocking.SinkholeIPv6
+		}
+		if ip != "" {
+			if rr, err := builders.NewRR(q.Qtype, q.Name, q.Name, ip, blocking.TTL); err == nil {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+	}
+	req.extendedError(dns.ExtendedErrorCodeBlocked, reason)
+	return true
+}
+
+// applyPolicy carries out what a response policy zone says about q, and
+// tells whether the answer is settled.
+func (app *App) applyPolicy(req *Request, m *dns.Msg, q dns.Question, hit *rpz.Hit) bool {
+	metrics.RPZHits.Add(hit.Zone, 1)
+	if app.Config.Settings.DebugLevel > 0 {
+		log.Printf("Policy for %s %s from %s: %s\n", q.Name, dns.TypeToString[q.Qtype], req.RemoteIP, hit)
+	}
+	switch hit.Action {
+	case rpz.Passthru:
+		req.Passthru = true
+		return false
+	case rpz.NXDomain, rpz.NoData:
+		m.Rcode = dns.RcodeSuccess
+		if hit.Action == rpz.NXDomain {
+			m.Rcode = dns.RcodeNameError
+		}
+		// Whatever our parent had to say is no longer true: the policy zone
+		// is the authority on this name.
+		m.Answer, m.Ns, m.Extra = nil, nil, nil
+		if soa := hit.SOA(); soa != nil {
+			m.Ns = []dns.RR{soa}
+		}
+		req.extendedError(dns.ExtendedErrorCodeBlocked, hit.String())
+	case rpz.Drop:
+		req.Drop = true
+	case rpz.TCPOnly:
+		if req.Transport != "udp" {
+			return false
+		}
+		m.Truncated = true
+		m.Answer = nil
+	case rpz.LocalData:
+		m.Rcode = dns.RcodeSuccess
+		m.Answer, m.Ns, m.Extra = hit.Answer(q), nil, nil
+		req.extendedError(dns.ExtendedErrorCodeForgedAnswer, hit.String())
+	default:
+		return false
+	}
+	return true
+}
+
+// ruleError explains what a rule did to the answer, using the extended error
+// the rule asks for, or the one fitting its action.
+func ruleError(req *Request, rule *config.Rule, fallback uint16) {
+	code, ok := config.ExtendedErrorCode(rule.EDE)
+	if !ok {
+		code = fallback
+	}
+	req.extendedError(code, rule.EDEText)
+}
+
+func (app *App) parseRules(req *Request, phase string, q dns.Question, answer dns.RR) *rules.Rule {
+	host := strings.ToLower(q.Name)
+	if app.Config.Settings.DebugLevel > 2 {
+		log.Printf("Parsing rules for host [%s], remoteip [%s]\n", host, req.RemoteIP)
+	}
+
+	env := req.View.Rules.Env()
+	env["host"] = host
+	env["qtype"] = dns.TypeToString[q.Qtype]
+	env["qclass"] = dns.ClassToString[q.Qclass]
+	env["zone"] = req.Zone
+	env["view"] = req.View.Name()
+
+	env["remoteip"] = req.RemoteIP
+	if req.ClientNet != nil {
+		env["clientnet"] = req.ClientNet.String()
+	}
+	if req.Subnet != nil {
+		env["ecs"] = fmt.Sprintf("%s/%d", req.Subnet.Address, req.Subnet.SourceNetmask)
+	}
+	env["verified"] = req.CookieVerified
+	env["tsig"] = req.TsigKey
+	env["transport"] = req.Transport
+	if req.Listener != nil {
+		env["listener"] = req.Listener.Address
+		env["listenername"] = req.Listener.Name
+	}
+
+	if answer != nil {
+		env["answertype"] = dns.TypeToString[answer.Header().Rrtype]
+		env["answerttl"] = int(answer.Header().Ttl)
+		switch rr := answer.(type) {
+		case *dns.A:
+			env["answerip"] = rr.A.String()
+		case *dns.AAAA:
+			env["answerip"] = rr.AAAA.String()
+		case *dns.CNAME:
+			env["answertarget"] = rr.Target
+		case *dns.MX:
+			env["answertarget"] = rr.Mx
+		case *dns.NS:
+			env["answertarget"] = rr.Ns
+		case *dns.SRV:
+			env["answertarget"] = rr.Target
+		case *dns.PTR:
+			env["answertarget"] = rr.Ptr
 		}
+	}
+
+	if len(req.Tags) > 0 {
+		env["tags"] = req.Tags
+	}
+
+	now := time.Now()
+	env["hour"] = now.Hour()
+	env["minute"] = now.Minute()
+	env["weekday"] = now.Weekday().String()
+
+	rule, err := req.View.Rules.Match(phase, env)
+	if err != nil {
+		log.Println("Bad rule", err)
+		return nil
+	}
+	if rule != nil {
 		// Matched
 		if app.Config.Settings.DebugLevel > 2 {
 			log.Println("Matched rule", rule.Condition, "->", rule.Action)
 		}
-		return rule.Action
+		return rule
 	}
 	if app.Config.Settings.DebugLevel > 2 {
 		log.Println("No rule applies")
 	}
-	return ""
-}
-
-func unquote(str string) string {
-	if len(str) > 0 && str[0] == '\'' {
-		str = str[1:]
-	}
-	if len(str) > 0 && str[len(str)-1] == '\'' {
-		str = str[:len(str)-1]
-	}
-	return str
+	return nil
 }
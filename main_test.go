@@ -84,6 +84,22 @@ func TestAuthoritative(t *testing.T) {
 	}
 }
 
+// RFC4892
+func TestChaosHostname(t *testing.T) {
+	result := runit("hostname.bind", "TXT", "CH")
+	if !lookup(result, `(?s)ANSWER SECTION:+hostname.bind. 0 CH TXT`) {
+		inform(t, `our hostname in the CHAOS class`, result)
+	}
+}
+
+// RFC8482
+func TestMinimalAny(t *testing.T) {
+	result := runit("example.com", "ANY")
+	if !lookup(result, `(?s)ANSWER SECTION:+example.com. 20 IN A 1.2.3.4`) || lookup(result, `IN MX`) {
+		inform(t, `a single RRset for example.com`, result)
+	}
+}
+
 func runit(args ...string) string {
 	stdout, err := exec.Command("dig", append([]string{"@localhost"}, args...)...).Output()
 	if err != nil {
@@ -0,0 +1,53 @@
+// Package metrics publishes our counters with expvar, so that they can be
+// scraped as JSON from /debug/vars.
+package metrics
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"sync"
+)
+
+var (
+	// Queries refused or dropped because their client went over its limit,
+	// in total and by what the client was known as: "ip", "prefix", "tsig"
+	// or "ecs".
+	ClientLimited   = expvar.NewInt("client_limited")
+	ClientLimitedBy = expvar.NewMap("client_limited_by")
+	// Responses dropped, or sent truncated, by response rate limiting.
+	RRLDropped = expvar.NewInt("rrl_dropped")
+	RRLSlipped = expvar.NewInt("rrl_slipped")
+	// State of each upstream's circuit breaker.
+	Breakers = expvar.NewMap("upstream_breakers")
+	// Answers served from expired cache entries, as upstreams failed us.
+	StaleAnswers = expvar.NewInt("stale_answers")
+	// Queries answered for blocklisted names.
+	Blocked = expvar.NewInt("blocked")
+	// Response policy zone hits, by zone.
+	RPZHits = expvar.NewMap("rpz_hits")
+)
+
+func SetBreakerState(upstream string, state string) {
+	value := new(expvar.String)
+	value.Set(state)
+	Breakers.Set(upstream, value)
+}
+
+var serving sync.Once
+
+// Serve exposes the metrics on address. Only the first call does anything:
+// the listener outlives configuration reloads.
+func Serve(address string) {
+	if address == "" {
+		return
+	}
+	serving.Do(func() {
+		go func() {
+			log.Printf("Serving metrics (%s)\n", address)
+			if err := http.ListenAndServe(address, expvar.Handler()); err != nil {
+				log.Println("Warning: unable to serve metrics:", err)
+			}
+		}()
+	})
+}
@@ -1,6 +1,8 @@
 package plugins
 
 import (
+	"net"
+
 	"github.com/miekg/dns"
 )
 
@@ -47,4 +49,22 @@ type Update struct {
 	Done     bool // Stop processing question
 	Question *dns.Question
 	RR       []dns.RR
+	// Extended DNS Error to attach to the answer, e.g. to tell why it was
+	// rewritten.
+	EDE *dns.EDNS0_EDE
+}
+
+// QueryInfo tells handlers more about the client behind a query.
+type QueryInfo struct {
+	RemoteIp string
+	// The network the client stands for, e.g. as stated by an EDNS Client
+	// Subnet option.
+	ClientNet *net.IPNet
+}
+
+// InfoHandler may be implemented by pre and post handlers that want to be
+// given a QueryInfo rather than just the client's address. When it is,
+// ProcessQueryInfo is called instead of ProcessQuery.
+type InfoHandler interface {
+	ProcessQueryInfo(p PreOrPost, info *QueryInfo, m *dns.Msg, q *dns.Question) (*Update, error)
 }
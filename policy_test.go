@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const policyZone = `$TTL 300
+@                        SOA  ns.rpz.test. hostmaster.rpz.test. 7 3600 600 86400 60
+                         NS   ns.rpz.test.
+walled.example.com       A    10.0.0.53
+24.0.113.0.203.rpz-ip    CNAME .
+`
+
+// referringRecursor answers with its parent's authority and glue, which
+// policies must not let through.
+type referringRecursor struct {
+	testRecursor
+}
+
+func (r *referringRecursor) Exchange(m *dns.Msg) (*dns.Msg, string, error) {
+	response, server, err := r.testRecursor.Exchange(m)
+	ns, _ := dns.NewRR("example.com. 3600 IN NS ns.example.com.")
+	glue, _ := dns.NewRR("ns.example.com. 3600 IN A 192.0.2.53")
+	response.Ns, response.Extra = []dns.RR{ns}, []dns.RR{glue}
+	return response, server, err
+}
+
+func TestPolicyResponses(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rpz.test.zone")
+	if err := os.WriteFile(file, []byte(policyZone), 0644); err != nil {
+		t.Fatal(err)
+	}
+	recursor := &referringRecursor{testRecursor{address: "203.0.113.7"}}
+	app := newTestApp(t, "[[rpz]]\nzone = \"rpz.test.\"\nfile = \""+file+"\"\n", recursor)
+
+	r := query("www.example.com.", dns.TypeA)
+	r.SetEdns0(1232, false)
+	response := ask(app, context.Background(), newTestWriter("udp"), "127.0.0.1:5353", r)
+	if response.Rcode != dns.RcodeNameError || len(response.Answer) != 0 {
+		t.Fatalf("Expected the answer's address to be denied, got %v", response)
+	}
+	if len(response.Ns) != 1 || response.Ns[0].Header().Name != "rpz.test." || response.Ns[0].Header().Rrtype != dns.TypeSOA || response.Ns[0].Header().Ttl != 60 {
+		t.Errorf("Expected the policy zone's SOA as the only authority, got %v", response.Ns)
+	}
+	for _, rr := range response.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			t.Errorf("Expected the upstream's additional records to be dropped, got %v", rr)
+		}
+	}
+	if errors := extendedErrors(response); len(errors) != 1 || errors[0].InfoCode != dns.ExtendedErrorCodeBlocked {
+		t.Errorf("Expected the policy to be given as the reason, got %v", errors)
+	}
+
+	calls := recursor.calls
+	r = query("walled.example.com.", dns.TypeA)
+	r.SetEdns0(1232, false)
+	response = ask(app, context.Background(), newTestWriter("udp"), "127.0.0.1:5353", r)
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 1 || response.Answer[0].(*dns.A).A.String() != "10.0.0.53" || len(response.Ns) != 0 {
+		t.Errorf("Expected the local data alone, got %v", response)
+	}
+	if errors := extendedErrors(response); len(errors) != 1 || errors[0].InfoCode != dns.ExtendedErrorCodeForgedAnswer {
+		t.Errorf("Expected the answer to be marked as forged, got %v", errors)
+	}
+	if recursor.calls != calls {
+		t.Error("Expected the local data to be answered without a lookup")
+	}
+}
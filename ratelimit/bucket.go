@@ -0,0 +1,41 @@
+// Package ratelimit keeps clients from abusing us: response rate limiting
+// against reflection attacks, and per client query limits.
+package ratelimit
+
+import (
+	"time"
+)
+
+// bucket is a token bucket, refilled at rate tokens per second, holding at
+// most burst tokens.
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// Responses dropped since the last one that went through.
+	dropped uint32
+}
+
+func (b *bucket) take(now time.Time, rate float64, burst float64) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full tells whether a bucket has been idle long enough to be forgotten.
+func (b *bucket) full(now time.Time, rate float64, burst float64) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*rate >= burst
+}
+
+// How often idle buckets are swept away.
+const sweepInterval = time.Minute
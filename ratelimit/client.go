@@ -0,0 +1,115 @@
+package ratelimit
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fusion/kittendns/config"
+)
+
+type clientEntry struct {
+	bucket
+	identity string
+}
+
+// Limiter throttles clients sending more than their share of queries.
+type Limiter struct {
+	sync.Mutex
+	buckets map[string]*list.Element
+	// Clients, most recently seen first, so that the table can be kept
+	// within size by forgetting the others.
+	recent *list.List
+	size   int
+	rate   float64
+	burst  float64
+	exempt []*net.IPNet
+	swept  time.Time
+	now    func() time.Time
+}
+
+// NewLimiter returns nil if no limit is configured.
+func NewLimiter(settings config.ClientLimit) (*Limiter, error) {
+	if settings.QPS == 0 {
+		return nil, nil
+	}
+	limiter := &Limiter{
+		buckets: make(map[string]*list.Element),
+		recent:  list.New(),
+		size:    int(settings.TableSize),
+		rate:    float64(settings.QPS),
+		burst:   float64(settings.Burst),
+		now:     time.Now,
+	}
+	if limiter.burst < limiter.rate {
+		limiter.burst = limiter.rate
+	}
+	if limiter.size == 0 {
+		limiter.size = defaultTableSize
+	}
+	for _, network := range settings.Exempt {
+		_, cidr, err := net.ParseCIDR(network)
+		if err != nil {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, err
+			}
+			bits := 8 * len(ip)
+			cidr = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		limiter.exempt = append(limiter.exempt, cidr)
+	}
+	return limiter, nil
+}
+
+// Exempt tells whether client is never limited.
+func (l *Limiter) Exempt(client net.IP) bool {
+	for _, network := range l.exempt {
+		if network.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allow accounts for a query from the client known as identity. When it is
+// not allowed, first tells whether this is the first query refused since the
+// client was last within its limit.
+func (l *Limiter) Allow(identity string) (allowed bool, first bool) {
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	if now.Sub(l.swept) >= sweepInterval {
+		l.swept = now
+		for _, element := range l.buckets {
+			if element.Value.(*clientEntry).full(now, l.rate, l.burst) {
+				l.forget(element)
+			}
+		}
+	}
+	var b *clientEntry
+	if element, ok := l.buckets[identity]; ok {
+		l.recent.MoveToFront(element)
+		b = element.Value.(*clientEntry)
+	} else {
+		// Spoofed sources must not exhaust our memory: the least recently
+		// seen clients are forgotten first.
+		for len(l.buckets) >= l.size {
+			l.forget(l.recent.Back())
+		}
+		b = &clientEntry{identity: identity}
+		l.buckets[identity] = l.recent.PushFront(b)
+	}
+	if b.take(now, l.rate, l.burst) {
+		b.dropped = 0
+		return true, false
+	}
+	b.dropped++
+	return false, b.dropped == 1
+}
+
+func (l *Limiter) forget(element *list.Element) {
+	delete(l.buckets, element.Value.(*clientEntry).identity)
+	l.recent.Remove(element)
+}
@@ -0,0 +1,69 @@
+package ratelimit
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fusion/kittendns/config"
+)
+
+func TestLimiter(t *testing.T) {
+	limiter, err := NewLimiter(config.ClientLimit{QPS: 1, Burst: 3, Exempt: []string{"10.0.0.0/8", "192.0.2.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := limiter.Allow("192.0.2.2"); !allowed {
+			t.Fatalf("Expected query %d to be within the burst", i)
+		}
+	}
+	if allowed, first := limiter.Allow("192.0.2.2"); allowed || !first {
+		t.Errorf("Expected the first query over the limit to be refused and reported")
+	}
+	if allowed, first := limiter.Allow("192.0.2.2"); allowed || first {
+		t.Errorf("Expected the next query over the limit to be refused quietly")
+	}
+	if allowed, _ := limiter.Allow("192.0.2.3"); !allowed {
+		t.Errorf("Expected other clients not to be limited")
+	}
+	now = now.Add(time.Second)
+	if allowed, _ := limiter.Allow("192.0.2.2"); !allowed {
+		t.Errorf("Expected the bucket to refill")
+	}
+
+	for _, exempt := range []string{"10.1.2.3", "192.0.2.1"} {
+		if !limiter.Exempt(net.ParseIP(exempt)) {
+			t.Errorf("Expected %s to be exempt", exempt)
+		}
+	}
+	if limiter.Exempt(net.ParseIP("192.0.2.2")) {
+		t.Errorf("Expected 192.0.2.2 not to be exempt")
+	}
+}
+
+func TestLimiterTableSize(t *testing.T) {
+	limiter, _ := NewLimiter(config.ClientLimit{QPS: 1, TableSize: 2})
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	limiter.Allow("192.0.2.1")
+	limiter.Allow("198.51.100.1")
+	// The first client was seen last, the second is forgotten.
+	if allowed, _ := limiter.Allow("192.0.2.1"); allowed {
+		t.Error("Expected the first client to be limited")
+	}
+	limiter.Allow("203.0.113.1")
+	if len(limiter.buckets) != 2 || limiter.recent.Len() != 2 {
+		t.Fatalf("Expected 2 clients, got %d", len(limiter.buckets))
+	}
+	if allowed, _ := limiter.Allow("192.0.2.1"); allowed {
+		t.Error("Expected the first client to be remembered")
+	}
+	if allowed, _ := limiter.Allow("198.51.100.1"); !allowed {
+		t.Error("Expected the second client to be forgotten")
+	}
+}
@@ -0,0 +1,176 @@
+package ratelimit
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fusion/kittendns/config"
+	"github.com/miekg/dns"
+)
+
+type Verdict int
+
+const (
+	Allow Verdict = iota
+	// Do not answer at all.
+	Drop
+	// Answer with an empty, truncated response: a genuine client will retry
+	// over TCP, which cannot be spoofed.
+	Slip
+)
+
+type category int
+
+const (
+	responses category = iota
+	nxdomains
+	failures
+)
+
+// Responses tracked at once, unless configured otherwise.
+const defaultTableSize = 100000
+
+type rrlEntry struct {
+	bucket
+	kind category
+	key  string
+}
+
+// RRL implements BIND style Response Rate Limiting: identical responses
+// sent to the same network are limited, so that we are not much use to
+// attackers spoofing their victim's address.
+type RRL struct {
+	sync.Mutex
+	buckets map[string]*list.Element
+	// Entries, most recently seen first, so that the table can be kept
+	// within size by forgetting the others.
+	recent  *list.List
+	size    int
+	rates   [3]float64
+	slip    uint32
+	prefix4 int
+	prefix6 int
+	swept   time.Time
+	now     func() time.Time
+}
+
+// NewRRL returns nil if no limit is configured.
+func NewRRL(settings config.RRL) *RRL {
+	if settings.ResponsesPerSecond == 0 && settings.NXDomainsPerSecond == 0 && settings.ErrorsPerSecond == 0 {
+		return nil
+	}
+	rrl := &RRL{
+		buckets: make(map[string]*list.Element),
+		recent:  list.New(),
+		size:    int(settings.TableSize),
+		rates: [3]float64{
+			float64(settings.ResponsesPerSecond),
+			float64(settings.NXDomainsPerSecond),
+			float64(settings.ErrorsPerSecond),
+		},
+		slip:    settings.Slip,
+		prefix4: int(settings.IPv4Prefix),
+		prefix6: int(settings.IPv6Prefix),
+		now:     time.Now,
+	}
+	if rrl.prefix4 == 0 || rrl.prefix4 > 32 {
+		rrl.prefix4 = 24
+	}
+	if rrl.prefix6 == 0 || rrl.prefix6 > 128 {
+		rrl.prefix6 = 56
+	}
+	if rrl.size == 0 {
+		rrl.size = defaultTableSize
+	}
+	return rrl
+}
+
+// Check accounts for the response m about to be sent to client.
+func (r *RRL) Check(client net.IP, m *dns.Msg) Verdict {
+	kind, identity := r.identify(m)
+	rate := r.rates[kind]
+	if rate == 0 || client == nil {
+		return Allow
+	}
+	key := fmt.Sprintf("%s|%d|%s", Network(client, r.prefix4, r.prefix6), kind, identity)
+
+	r.Lock()
+	defer r.Unlock()
+	now := r.now()
+	r.sweep(now)
+	var b *rrlEntry
+	if element, ok := r.buckets[key]; ok {
+		r.recent.MoveToFront(element)
+		b = element.Value.(*rrlEntry)
+	} else {
+		// Spoofed queries from many networks must not exhaust our memory:
+		// the least recently seen responses are forgotten first.
+		for len(r.buckets) >= r.size {
+			r.forget(r.recent.Back())
+		}
+		b = &rrlEntry{kind: kind, key: key}
+		r.buckets[key] = r.recent.PushFront(b)
+	}
+	if b.take(now, rate, rate) {
+		b.dropped = 0
+		return Allow
+	}
+	b.dropped++
+	if r.slip > 0 && b.dropped%r.slip == 0 {
+		return Slip
+	}
+	return Drop
+}
+
+// identify tells which limit applies to a response, and what makes it
+// identical to others. Name errors count against the zone, not the name, as
+// random names are cheap.
+func (r *RRL) identify(m *dns.Msg) (category, string) {
+	var q dns.Question
+	if len(m.Question) > 0 {
+		q = m.Question[0]
+	}
+	switch m.Rcode {
+	case dns.RcodeSuccess:
+		return responses, fmt.Sprintf("%s/%d", strings.ToLower(q.Name), q.Qtype)
+	case dns.RcodeNameError:
+		for _, rr := range m.Ns {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				return nxdomains, strings.ToLower(rr.Header().Name)
+			}
+		}
+		return nxdomains, strings.ToLower(q.Name)
+	default:
+		return failures, ""
+	}
+}
+
+func (r *RRL) sweep(now time.Time) {
+	if now.Sub(r.swept) < sweepInterval {
+		return
+	}
+	r.swept = now
+	for _, element := range r.buckets {
+		b := element.Value.(*rrlEntry)
+		if b.full(now, r.rates[b.kind], r.rates[b.kind]) {
+			r.forget(element)
+		}
+	}
+}
+
+func (r *RRL) forget(element *list.Element) {
+	delete(r.buckets, element.Value.(*rrlEntry).key)
+	r.recent.Remove(element)
+}
+
+// Network returns the network client belongs to, as far as limits go.
+func Network(client net.IP, prefix4 int, prefix6 int) string {
+	if client4 := client.To4(); client4 != nil {
+		return (&net.IPNet{IP: client4.Mask(net.CIDRMask(prefix4, 32)), Mask: net.CIDRMask(prefix4, 32)}).String()
+	}
+	return (&net.IPNet{IP: client.Mask(net.CIDRMask(prefix6, 128)), Mask: net.CIDRMask(prefix6, 128)}).String()
+}
@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fusion/kittendns/config"
+	"github.com/miekg/dns"
+)
+
+func response(name string, rcode int) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	m.Rcode = rcode
+	return m
+}
+
+func TestRRL(t *testing.T) {
+	rrl := NewRRL(config.RRL{ResponsesPerSecond: 2, NXDomainsPerSecond: 1, Slip: 2})
+	now := time.Now()
+	rrl.now = func() time.Time { return now }
+	victim := net.ParseIP("192.0.2.1")
+	neighbour := net.ParseIP("192.0.2.200")
+
+	expect := func(client net.IP, m *dns.Msg, want Verdict) {
+		t.Helper()
+		if got := rrl.Check(client, m); got != want {
+			t.Errorf("Expected %d, got %d", want, got)
+		}
+	}
+	expect(victim, response("example.com.", dns.RcodeSuccess), Allow)
+	expect(victim, response("example.com.", dns.RcodeSuccess), Allow)
+	// Same network, same response
+	expect(neighbour, response("example.com.", dns.RcodeSuccess), Drop)
+	expect(victim, response("example.com.", dns.RcodeSuccess), Slip)
+	// Another response, or another network
+	expect(victim, response("www.example.com.", dns.RcodeSuccess), Allow)
+	expect(net.ParseIP("198.51.100.1"), response("example.com.", dns.RcodeSuccess), Allow)
+	// No limit on errors
+	for i := 0; i < 5; i++ {
+		expect(victim, response("example.com.", dns.RcodeServerFailure), Allow)
+	}
+
+	now = now.Add(time.Second)
+	expect(victim, response("example.com.", dns.RcodeSuccess), Allow)
+}
+
+func TestNXDomainsCountAgainstZone(t *testing.T) {
+	rrl := NewRRL(config.RRL{NXDomainsPerSecond: 1})
+	soa, _ := dns.NewRR("example.com. 300 IN SOA ns.example.com. admin.example.com. 1 86400 7200 100800 300")
+	client := net.ParseIP("2001:db8::1")
+	for i, name := range []string{"a.example.com.", "b.example.com."} {
+		m := response(name, dns.RcodeNameError)
+		m.Ns = []dns.RR{soa}
+		verdict := rrl.Check(client, m)
+		if (i == 0) != (verdict == Allow) {
+			t.Errorf("Unexpected verdict %d for %s", verdict, name)
+		}
+	}
+}
+
+func TestTableSize(t *testing.T) {
+	rrl := NewRRL(config.RRL{ResponsesPerSecond: 1, TableSize: 2})
+	now := time.Now()
+	rrl.now = func() time.Time { return now }
+	m := response("example.com.", dns.RcodeSuccess)
+	first, second, third := net.ParseIP("192.0.2.1"), net.ParseIP("198.51.100.1"), net.ParseIP("203.0.113.1")
+
+	rrl.Check(first, m)
+	rrl.Check(second, m)
+	// The first network was seen last, the second is forgotten.
+	if verdict := rrl.Check(first, m); verdict != Drop {
+		t.Errorf("Expected the first network to be limited, got %d", verdict)
+	}
+	rrl.Check(third, m)
+	if len(rrl.buckets) != 2 || rrl.recent.Len() != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(rrl.buckets))
+	}
+	if verdict := rrl.Check(first, m); verdict != Drop {
+		t.Errorf("Expected the first network to be remembered, got %d", verdict)
+	}
+	if verdict := rrl.Check(second, m); verdict != Allow {
+		t.Errorf("Expected the second network to be forgotten, got %d", verdict)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"net"
+
+	"github.com/fusion/kittendns/config"
+	"github.com/miekg/dns"
+)
+
+// Request holds what we know about a query, and the client that sent it.
+type Request struct {
+	RemoteIP string
+	// "udp" or "tcp"
+	Transport string
+	// Name of the key that signed the query, once validated.
+	TsigKey string
+	// Origin of the zone we are authoritative for, if any.
+	Zone string
+	// The listener the query came in through, if listeners are defined.
+	Listener *config.Listener
+	// What the client gets to see
+	View *View
+	// The network the client stands for: the one stated in its EDNS Client
+	// Subnet option, if we trust it, or its own address otherwise.
+	ClientNet *net.IPNet
+	// EDNS Client Subnet option received from the client, if any.
+	Subnet *dns.EDNS0_SUBNET
+	// The client is trusted with its subnet, which ClientNet is set to.
+	SubnetTrusted bool
+	// Scope of the answer we are giving, as far as client subnets go.
+	SubnetScope uint8
+	// The client presented a valid server cookie: its address is not spoofed.
+	CookieVerified bool
+	// Cookie to send back, if the client sent one.
+	Cookie *dns.EDNS0_COOKIE
+	// Labels given by the rules that matched.
+	Tags []string
+	// A rule, or policy, decided that the query does not deserve an answer.
+	Drop bool
+	// A response policy zone let the question through: no other policy
+	// applies.
+	Passthru bool
+	// The first response policy zone to check once the answer is known.
+	PolicyZone int
+	// Names we followed CNAMEs to, within our own zones.
+	Chased map[string]bool
+	// Extended DNS Errors explaining our answer.
+	Errors []*dns.EDNS0_EDE
+}
+
+var errBadSubnet = errors.New("malformed client subnet option")
+
+func newRequest(remoteAddr string, r *dns.Msg, settings config.ClientSubnet) (*Request, error) {
+	req := &Request{}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	req.RemoteIP = host
+	if ip := net.ParseIP(host); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		req.ClientNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+
+	opt := r.IsEdns0()
+	if opt == nil {
+		return req, nil
+	}
+	for _, option := range opt.Option {
+		subnet, ok := option.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+		// RFC 7871 section 7.1.1
+		bits := 0
+		switch subnet.Family {
+		case 1:
+			bits = 32
+		case 2:
+			bits = 128
+		default:
+			return req, errBadSubnet
+		}
+		if int(subnet.SourceNetmask) > bits || subnet.SourceScope != 0 {
+			return req, errBadSubnet
+		}
+		req.Subnet = subnet
+		if !trusted(req.ClientNet, settings.Trusted) {
+			continue
+		}
+		mask := net.CIDRMask(int(subnet.SourceNetmask), bits)
+		ip := subnet.Address.Mask(mask)
+		if ip != nil {
+			req.ClientNet = &net.IPNet{IP: ip, Mask: mask}
+			req.SubnetTrusted = true
+		}
+	}
+	return req, nil
+}
+
+// trusted tells whether the client belongs to one of the networks we accept
+// client subnets from. An empty list trusts no one: anybody could claim to
+// stand for any network.
+func trusted(client *net.IPNet, networks []string) bool {
+	if client == nil {
+		return false
+	}
+	for _, network := range networks {
+		_, cidr, err := net.ParseCIDR(network)
+		if err != nil {
+			if ip := net.ParseIP(network); ip != nil && ip.Equal(client.IP) {
+				return true
+			}
+			continue
+		}
+		if cidr.Contains(client.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamSubnet builds the client subnet option to send to our parents, if
+// configured to do so. The source prefix is truncated to what we are willing
+// to disclose about our clients.
+func (req *Request) upstreamSubnet(settings config.ClientSubnet) *dns.EDNS0_SUBNET {
+	if !settings.Forward || req.ClientNet == nil {
+		return nil
+	}
+	// The client asked for its privacy to be respected.
+	if req.Subnet != nil && req.Subnet.SourceNetmask == 0 {
+		return nil
+	}
+	ones, bits := req.ClientNet.Mask.Size()
+	family, limit := uint16(1), settings.SourcePrefix4
+	if limit == 0 {
+		limit = 24
+	}
+	if bits == 128 {
+		family, limit = 2, settings.SourcePrefix6
+		if limit == 0 {
+			limit = 56
+		}
+	}
+	if ones > int(limit) {
+		ones = int(limit)
+	}
+	return &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: uint8(ones),
+		Address:       req.ClientNet.IP.Mask(net.CIDRMask(ones, bits)),
+	}
+}
+
+// extendedError records why our answer is what it is. Only the first reason
+// given for each error code is kept.
+func (req *Request) extendedError(code uint16, text string) {
+	for _, known := range req.Errors {
+		if known.InfoCode == code {
+			return
+		}
+	}
+	req.Errors = append(req.Errors, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
+
+// matchACL tells whether the client's actual address, or the key that signed
+// its query, is in the access list.
+func (req *Request) matchACL(acl []string) bool {
+	ip := net.ParseIP(req.RemoteIP)
+	for _, entry := range acl {
+		if req.TsigKey != "" && entry == req.TsigKey {
+			return true
+		}
+		if ip == nil {
+			continue
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if cidr.Contains(ip) {
+				return true
+			}
+		} else if allowed := net.ParseIP(entry); allowed != nil && allowed.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/fusion/kittendns/config"
+	"github.com/fusion/kittendns/metrics"
+	"github.com/miekg/dns"
+)
+
+func withSubnet(family uint16, netmask uint8, scope uint8, address string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.SetEdns0(1232, false)
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: netmask,
+		SourceScope:   scope,
+		Address:       net.ParseIP(address),
+	})
+	return m
+}
+
+func TestClientSubnet(t *testing.T) {
+	r := withSubnet(1, 24, 0, "198.51.100.77")
+	for _, test := range []struct {
+		client   string
+		trusted  []string
+		expected string
+	}{
+		{"10.0.0.1:5353", []string{"10.0.0.0/8"}, "198.51.100.0/24"},
+		{"10.0.0.1:5353", []string{"10.0.0.1"}, "198.51.100.0/24"},
+		{"192.0.2.1:5353", []string{"10.0.0.0/8"}, "192.0.2.1/32"},
+		// Nobody is trusted by default
+		{"10.0.0.1:5353", nil, "10.0.0.1/32"},
+	} {
+		req, err := newRequest(test.client, r, config.ClientSubnet{Trusted: test.trusted})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.ClientNet.String() != test.expected {
+			t.Errorf("From %s trusting %v: expected %s, got %s", test.client, test.trusted, test.expected, req.ClientNet)
+		}
+		if req.Subnet == nil {
+			t.Errorf("From %s: expected the option to be answered in kind", test.client)
+		}
+	}
+}
+
+func TestMalformedClientSubnet(t *testing.T) {
+	for _, r := range []*dns.Msg{
+		withSubnet(3, 24, 0, "198.51.100.0"),
+		withSubnet(1, 33, 0, "198.51.100.0"),
+		withSubnet(2, 129, 0, "2001:db8::"),
+		// Scopes are for answers
+		withSubnet(1, 24, 24, "198.51.100.0"),
+	} {
+		if _, err := newRequest("10.0.0.1:5353", r, config.ClientSubnet{Trusted: []string{"10.0.0.0/8"}}); err != errBadSubnet {
+			t.Errorf("Expected %v to be rejected, got %v", r.IsEdns0().Option[0], err)
+		}
+	}
+}
+
+func TestUpstreamSubnet(t *testing.T) {
+	settings := config.ClientSubnet{Trusted: []string{"10.0.0.0/8"}, Forward: true, SourcePrefix4: 20}
+	req, err := newRequest("10.0.0.1:5353", withSubnet(1, 24, 0, "198.51.100.77"), settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnet := req.upstreamSubnet(settings)
+	if subnet == nil || subnet.SourceNetmask != 20 || subnet.Address.String() != "198.51.96.0" {
+		t.Fatalf("Expected the source prefix to be clamped to /20, got %v", subnet)
+	}
+
+	// The client asked for its privacy to be respected.
+	req, _ = newRequest("10.0.0.1:5353", withSubnet(1, 0, 0, "0.0.0.0"), settings)
+	if subnet := req.upstreamSubnet(settings); subnet != nil {
+		t.Errorf("Expected no subnet to be forwarded, got %v", subnet)
+	}
+
+	// Our parent cannot make its answer valid for a network narrower than
+	// the one we asked about.
+	response := withSubnet(1, 20, 28, "198.51.96.0")
+	if scope := answerScope(response, subnet); scope == nil || scope.String() != "198.51.96.0/20" {
+		t.Errorf("Expected the scope to be clamped to /20, got %v", scope)
+	}
+	response = withSubnet(1, 20, 16, "198.51.96.0")
+	if scope := answerScope(response, subnet); scope == nil || scope.String() != "198.51.0.0/16" {
+		t.Errorf("Expected a /16 scope, got %v", scope)
+	}
+}
+
+func TestClientLimitBySubnet(t *testing.T) {
+	app := newTestApp(t, `
+[settings.clientsubnet]
+trusted = ["10.0.0.0/8"]
+[settings.clientlimit]
+qps = 1
+identity = "ecs"
+`+largeZone, nil)
+	limited := func(client string, address string) bool {
+		r := withSubnet(1, 24, 0, address)
+		r.Question[0].Name = "many.example.com."
+		return ask(app, context.Background(), newTestWriter("tcp"), client, r).Rcode == dns.RcodeRefused
+	}
+	before := metrics.ClientLimitedBy.Get("ecs")
+	if limited("10.0.0.1:5353", "198.51.100.1") || limited("10.0.0.1:5353", "203.0.113.1") {
+		t.Error("Expected each trusted subnet to have its own limit")
+	}
+	if !limited("10.0.0.1:5353", "198.51.100.1") {
+		t.Error("Expected the trusted subnet to be limited")
+	}
+	if after := metrics.ClientLimitedBy.Get("ecs"); after == nil || before != nil && after.String() == before.String() {
+		t.Error("Expected the limit to be counted against the ecs identity")
+	}
+	// Anybody else is known by its address, whatever subnet it states.
+	if limited("192.168.0.1:5353", "198.51.100.1") || !limited("192.168.0.1:5353", "203.0.113.1") {
+		t.Error("Expected the untrusted client to be limited by address")
+	}
+}
@@ -0,0 +1,334 @@
+// Package rpz evaluates Response Policy Zones: zones whose records say which
+// names, addresses or clients get a made up answer, or none at all.
+//
+// Zones are checked in the order they were given, and the first one with a
+// matching trigger decides. Within a zone, triggers are checked in the order
+// of the specification: CLIENT-IP, QNAME, IP, then NSDNAME. Client and name
+// triggers are checked before resolution, as far as the first zone that may
+// be triggered by the answer.
+package rpz
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/fusion/kittendns/config"
+	"github.com/fusion/kittendns/lists"
+	"github.com/miekg/dns"
+)
+
+const (
+	// Between two transfers, when the zone does not tell
+	defaultRefresh = time.Hour
+	// Before trying again, when a transfer failed
+	retryInterval = time.Minute
+)
+
+// Hit is a policy triggered by a query, or its answer.
+type Hit struct {
+	Zone string
+	// "client-ip", "qname", "ip" or "nsdname"
+	Trigger string
+	// The trigger's name in the zone
+	Owner  string
+	Action Action
+	data   []dns.RR
+	soa    *dns.SOA
+}
+
+func (h *Hit) String() string {
+	return fmt.Sprintf("%s %s %s (%s)", h.Zone, h.Trigger, strings.TrimSuffix(h.Owner, "."+h.Zone), h.Action)
+}
+
+// SOA returns the zone's SOA record, for the authority section of made up
+// negative answers, or nil if the zone has none. Its TTL is the negative
+// caching TTL (RFC 2308).
+func (h *Hit) SOA() dns.RR {
+	if h.soa == nil {
+		return nil
+	}
+	soa := dns.Copy(h.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
+// Answer returns the local data fitting q, owned by its name.
+func (h *Hit) Answer(q dns.Question) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range h.data {
+		if rr.Header().Rrtype != q.Qtype && rr.Header().Rrtype != dns.TypeCNAME && q.Qtype != dns.TypeANY {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+type source struct {
+	sync.RWMutex
+	definition config.RPZ
+	override   *Action
+	zone       *zone
+}
+
+// Policies are the response policy zones, in priority order.
+type Policies struct {
+	sources []*source
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+// New loads the zones. Files must be readable, but primaries that cannot be
+// reached yet are only warned about: their zone stays empty until they are.
+// Zones do not follow changes until Watch is called.
+func New(definitions []config.RPZ) (*Policies, error) {
+	policies := &Policies{done: make(chan struct{})}
+	for _, definition := range definitions {
+		source := &source{definition: definition, zone: &zone{name: definition.Zone}}
+		if definition.Policy != "" {
+			action, ok := ParseAction(definition.Policy)
+			if !ok {
+				return nil, fmt.Errorf("response policy zone %s: unknown policy %s", definition.Zone, definition.Policy)
+			}
+			source.override = &action
+		}
+		if err := source.load(); err != nil {
+			if definition.File != "" {
+				return nil, fmt.Errorf("response policy zone %s: %s", definition.Zone, err)
+			}
+			log.Printf("Warning: unable to transfer response policy zone %s: %s\n", definition.Zone, err)
+		}
+		policies.sources = append(policies.sources, source)
+	}
+	return policies, nil
+}
+
+// load (re)reads the zone, which is left as it was if anything is wrong.
+func (s *source) load() error {
+	var z *zone
+	var err error
+	if s.definition.File != "" {
+		z, err = readZone(s.definition.Zone, s.definition.File)
+	} else {
+		z, err = transferZone(s.definition.Zone, s.definition.Primary)
+	}
+	if err != nil {
+		return err
+	}
+	if z.skipped > 0 {
+		log.Printf("Response policy zone %s: skipped %d unsupported triggers.\n", z.name, z.skipped)
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.zone = z
+	return nil
+}
+
+func (s *source) current() *zone {
+	s.RLock()
+	defer s.RUnlock()
+	return s.zone
+}
+
+// hit reports the policy triggered in zone z, unless the zone is disabled:
+// its hits are only logged, and the next zones get their say.
+func (s *source) hit(z *zone, name string, trigger string, p *policy) *Hit {
+	hit := &Hit{Zone: s.definition.Zone, Trigger: trigger, Owner: p.owner, Action: p.action, data: p.data, soa: z.soa}
+	if s.override != nil {
+		hit.Action = *s.override
+		hit.data = nil
+	}
+	if hit.Action == Disabled {
+		log.Printf("Disabled response policy for %s: %s\n", name, hit)
+		return nil
+	}
+	return hit
+}
+
+// checkQuery looks for a policy of the zone triggered by the client's
+// address, or the name it asks for.
+func (s *source) checkQuery(z *zone, name string, client net.IP) *Hit {
+	if client != nil {
+		if policy := z.clientIP.match(client); policy != nil {
+			if hit := s.hit(z, name, "client-ip", policy); hit != nil {
+				return hit
+			}
+		}
+	}
+	if policy := z.qname.match(name); policy != nil {
+		return s.hit(z, name, "qname", policy)
+	}
+	return nil
+}
+
+// checkResponse looks for a policy of the zone triggered by the addresses in
+// an answer, or the name servers it names. Only name servers found in the
+// answer and authority sections are known.
+func (s *source) checkResponse(z *zone, name string, answer []dns.RR, authority []dns.RR) *Hit {
+	for _, rr := range answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if policy := z.ip.match(ip); policy != nil {
+			if hit := s.hit(z, name, "ip", policy); hit != nil {
+				return hit
+			}
+		}
+	}
+	for _, rrs := range [][]dns.RR{answer, authority} {
+		for _, rr := range rrs {
+			if ns, ok := rr.(*dns.NS); ok {
+				if policy := z.nsdname.match(ns.Ns); policy != nil {
+					if hit := s.hit(z, name, "nsdname", policy); hit != nil {
+						return hit
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// CheckQuery looks for a policy triggered by the client's address, or the
+// name it asks for, before resolution. It stops at the first zone that may
+// be triggered by the answer, which takes precedence over the zones after it,
+// and returns that zone's index: CheckResponse carries on from there. If
+// there is no such zone, the index is past the last one.
+func (p *Policies) CheckQuery(name string, client net.IP) (*Hit, int) {
+	if p == nil {
+		return nil, 0
+	}
+	for idx, source := range p.sources {
+		z := source.current()
+		if hit := source.checkQuery(z, name, client); hit != nil {
+			return hit, len(p.sources)
+		}
+		// A disabled zone only logs: its answer triggers cannot decide.
+		if z.answerTriggers() && (source.override == nil || *source.override != Disabled) {
+			return nil, idx
+		}
+	}
+	return nil, len(p.sources)
+}
+
+// CheckResponse carries on from the zone CheckQuery stopped at, looking for
+// a policy triggered by the answer to the query, or else, in the zones after
+// it, by the client's address or the name it asks for.
+func (p *Policies) CheckResponse(from int, name string, client net.IP, answer []dns.RR, authority []dns.RR) *Hit {
+	if p == nil {
+		return nil
+	}
+	for idx := from; idx < len(p.sources); idx++ {
+		source := p.sources[idx]
+		z := source.current()
+		if idx > from {
+			if hit := source.checkQuery(z, name, client); hit != nil {
+				return hit
+			}
+		}
+		if hit := source.checkResponse(z, name, answer, authority); hit != nil {
+			return hit
+		}
+	}
+	return nil
+}
+
+// Watch reloads zone files whenever they change, and transfers zones again
+// as often as they ask to, until Close is called.
+func (p *Policies) Watch() error {
+	byPath := map[string][]*source{}
+	var paths []string
+	for _, source := range p.sources {
+		if source.definition.File == "" {
+			go source.refresh(p.done)
+			continue
+		}
+		path := filepath.Clean(source.definition.File)
+		if _, ok := byPath[path]; !ok {
+			paths = append(paths, path)
+		}
+		byPath[path] = append(byPath[path], source)
+	}
+	watcher, err := lists.WatchFiles(paths, func(path string) {
+		for _, source := range byPath[path] {
+			if err := source.load(); err != nil {
+				log.Printf("Warning: unable to reload response policy zone %s: %s\n", source.definition.Zone, err)
+				continue
+			}
+			log.Printf("Response policy zone %s reloaded.\n", source.definition.Zone)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	p.watcher = watcher
+	return nil
+}
+
+// refresh transfers the zone again whenever its primary has a new serial.
+func (s *source) refresh(done chan struct{}) {
+	for {
+		interval := retryInterval
+		if z := s.current(); z.serial != 0 {
+			interval = time.Duration(z.refresh) * time.Second
+			if s.definition.Refresh > 0 {
+				interval = time.Duration(s.definition.Refresh) * time.Second
+			}
+			if interval == 0 {
+				interval = defaultRefresh
+			}
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+		if serial, err := querySerial(s.definition.Zone, s.definition.Primary); err == nil && serial == s.current().serial {
+			continue
+		}
+		if err := s.load(); err != nil {
+			log.Printf("Warning: unable to transfer response policy zone %s: %s\n", s.definition.Zone, err)
+			continue
+		}
+		log.Printf("Response policy zone %s transferred, serial %d.\n", s.definition.Zone, s.current().serial)
+	}
+}
+
+func querySerial(name string, primary string) (uint32, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeSOA)
+	response, err := dns.Exchange(m, primary)
+	if err != nil {
+		return 0, err
+	}
+	for _, rr := range response.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+	return 0, fmt.Errorf("no SOA for %s", name)
+}
+
+// Close stops following changes to zones.
+func (p *Policies) Close() {
+	close(p.done)
+	if p.watcher != nil {
+		p.watcher.Close()
+	}
+}
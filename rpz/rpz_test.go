@@ -0,0 +1,161 @@
+package rpz
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/fusion/kittendns/config"
+	"github.com/miekg/dns"
+)
+
+const testZone = `$TTL 300
+@                        SOA  ns.rpz.test. hostmaster.rpz.test. 7 3600 600 86400 60
+                         NS   ns.rpz.test.
+bad.example.com          CNAME .
+*.bad.example.com        CNAME .
+empty.example.com        CNAME *.
+ok.bad.example.com       CNAME rpz-passthru.
+quiet.example.com        CNAME rpz-drop.
+big.example.com          CNAME rpz-tcp-only.
+walled.example.com       A    10.0.0.53
+walled.example.com       AAAA fd00::53
+32.66.2.0.192.rpz-client-ip  CNAME rpz-drop.
+24.0.113.0.203.rpz-ip    CNAME .
+32.9.113.0.203.rpz-ip    CNAME rpz-passthru.
+48.zz.db8.2001.rpz-ip    CNAME *.
+ns.evil.test.rpz-nsdname CNAME .
+1.2.3.4.rpz-nsip         CNAME .
+`
+
+func load(t *testing.T, definition config.RPZ) *source {
+	z, err := parseZone("rpz.test.", strings.NewReader(testZone), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &source{definition: definition, zone: z}
+	if definition.Policy != "" {
+		action, _ := ParseAction(definition.Policy)
+		s.override = &action
+	}
+	return s
+}
+
+func TestTriggers(t *testing.T) {
+	policies := &Policies{sources: []*source{load(t, config.RPZ{Zone: "rpz.test."})}}
+	if z := policies.sources[0].zone; z.serial != 7 || z.skipped != 1 {
+		t.Errorf("Expected serial 7 and the NSIP trigger skipped, got %d, %d", z.serial, z.skipped)
+	}
+	for name, expected := range map[string]string{
+		"bad.example.com.":       "qname nxdomain",
+		"www.bad.example.com.":   "qname nxdomain",
+		"ok.bad.example.com.":    "qname passthru",
+		"empty.example.com.":     "qname nodata",
+		"quiet.example.com.":     "qname drop",
+		"big.example.com.":       "qname tcp-only",
+		"walled.example.com.":    "qname local-data",
+		"www.empty.example.com.": "",
+		"example.com.":           "",
+	} {
+		hit, _ := policies.CheckQuery(name, net.ParseIP("192.0.2.1"))
+		if (hit == nil) != (expected == "") || hit != nil && hit.Trigger+" "+hit.Action.String() != expected {
+			t.Errorf("Expected %s to hit '%s', got %v", name, expected, hit)
+		}
+	}
+	if hit, _ := policies.CheckQuery("example.com.", net.ParseIP("192.0.2.66")); hit == nil || hit.Trigger != "client-ip" || hit.Action != Drop {
+		t.Errorf("Expected the client to be dropped, got %v", hit)
+	}
+	hit, _ := policies.CheckQuery("walled.example.com.", nil)
+	answer := hit.Answer(dns.Question{Name: "Walled.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+	if len(answer) != 1 || answer[0].Header().Name != "Walled.example.com." || answer[0].(*dns.AAAA).AAAA.String() != "fd00::53" {
+		t.Errorf("Expected local data for the question, got %v", answer)
+	}
+
+	for ip, expected := range map[string]string{
+		"203.0.113.1": "ip nxdomain",
+		"203.0.113.9": "ip passthru",
+		"203.0.114.1": "",
+		"2001:db8::1": "ip nodata",
+		"2001:db9::1": "",
+	} {
+		rr, _ := dns.NewRR("example.com. 60 IN A 127.0.0.1")
+		if strings.Contains(ip, ":") {
+			rr = &dns.AAAA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET}, AAAA: net.ParseIP(ip)}
+		} else {
+			rr.(*dns.A).A = net.ParseIP(ip)
+		}
+		hit := policies.CheckResponse(0, "example.com.", nil, []dns.RR{rr}, nil)
+		if (hit == nil) != (expected == "") || hit != nil && hit.Trigger+" "+hit.Action.String() != expected {
+			t.Errorf("Expected %s to hit '%s', got %v", ip, expected, hit)
+		}
+	}
+	ns, _ := dns.NewRR("example.com. 60 IN NS ns.evil.test.")
+	if hit := policies.CheckResponse(0, "example.com.", nil, nil, []dns.RR{ns}); hit == nil || hit.Trigger != "nsdname" {
+		t.Errorf("Expected the name server to hit, got %v", hit)
+	}
+}
+
+func TestPriorityAndOverride(t *testing.T) {
+	policies := &Policies{sources: []*source{
+		load(t, config.RPZ{Zone: "rpz.test.", Policy: "nodata"}),
+		load(t, config.RPZ{Zone: "rpz.test."}),
+	}}
+	hit, _ := policies.CheckQuery("walled.example.com.", nil)
+	if hit == nil || hit.Action != NoData || len(hit.Answer(dns.Question{Name: "walled.example.com.", Qtype: dns.TypeA})) != 0 {
+		t.Errorf("Expected the first zone's override to win, got %v", hit)
+	}
+	if soa := hit.SOA(); soa == nil || soa.Header().Name != "rpz.test." || soa.Header().Ttl != 60 {
+		t.Errorf("Expected the zone's SOA, with its negative TTL, got %v", soa)
+	}
+
+	// Disabled zones only log their hits: the next zones decide.
+	policies.sources[0] = load(t, config.RPZ{Zone: "rpz.test.", Policy: "disabled"})
+	hit, _ = policies.CheckQuery("walled.example.com.", nil)
+	if hit == nil || hit.Action != LocalData || len(hit.Answer(dns.Question{Name: "walled.example.com.", Qtype: dns.TypeA})) != 1 {
+		t.Errorf("Expected the second zone's local data, got %v", hit)
+	}
+	rr, _ := dns.NewRR("example.com. 60 IN A 203.0.113.1")
+	if hit := policies.CheckResponse(0, "example.com.", nil, []dns.RR{rr}, nil); hit == nil || hit.Action != NXDomain {
+		t.Errorf("Expected the second zone's address trigger, got %v", hit)
+	}
+}
+
+func TestZoneOrder(t *testing.T) {
+	zone := func(name string, text string) *source {
+		z, err := parseZone(name, strings.NewReader(text), "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &source{definition: config.RPZ{Zone: name}, zone: z}
+	}
+	policies := &Policies{sources: []*source{
+		zone("first.test.", "24.0.113.0.203.rpz-ip.first.test. 300 CNAME .\n"),
+		zone("second.test.", "www.example.com.second.test. 300 CNAME *.\n"),
+		zone("third.test.", "32.0.113.0.203.rpz-ip.third.test. 300 CNAME rpz-passthru.\n"),
+	}}
+	// The first zone may be triggered by the answer: it has to be known.
+	hit, from := policies.CheckQuery("www.example.com.", nil)
+	if hit != nil || from != 0 {
+		t.Fatalf("Expected to wait for the answer, got %v, %d", hit, from)
+	}
+	for ip, expected := range map[string]string{
+		"203.0.113.1":  "first.test. ip nxdomain",
+		"198.51.100.1": "second.test. qname nodata",
+	} {
+		rr, _ := dns.NewRR("www.example.com. 60 IN A " + ip)
+		hit := policies.CheckResponse(from, "www.example.com.", nil, []dns.RR{rr}, nil)
+		if hit == nil || hit.Zone+" "+hit.Trigger+" "+hit.Action.String() != expected {
+			t.Errorf("For %s, expected '%s', got %v", ip, expected, hit)
+		}
+	}
+
+	// Once a zone decided, later ones are not asked.
+	policies.sources = policies.sources[1:]
+	hit, from = policies.CheckQuery("www.example.com.", nil)
+	if hit == nil || hit.Zone != "second.test." || from != 2 {
+		t.Errorf("Expected the second zone to decide before resolution, got %v, %d", hit, from)
+	}
+	if hit, from := policies.CheckQuery("other.example.com.", nil); hit != nil || from != 1 {
+		t.Errorf("Expected to wait for the answer, for the third zone, got %v, %d", hit, from)
+	}
+}
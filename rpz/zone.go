@@ -0,0 +1,348 @@
+package rpz
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Action is what a policy does to the answer.
+type Action int
+
+const (
+	NXDomain Action = iota
+	NoData
+	// Leave the answer alone, and stop looking for policies.
+	Passthru
+	// No response at all
+	Drop
+	// Truncated answers over UDP, so that clients retry over TCP
+	TCPOnly
+	// Answer with the policy's own records
+	LocalData
+	// Only log hits
+	Disabled
+)
+
+func (a Action) String() string {
+	switch a {
+	case NXDomain:
+		return "nxdomain"
+	case NoData:
+		return "nodata"
+	case Passthru:
+		return "passthru"
+	case Drop:
+		return "drop"
+	case TCPOnly:
+		return "tcp-only"
+	case LocalData:
+		return "local-data"
+	case Disabled:
+		return "disabled"
+	}
+	return "unknown"
+}
+
+// ParseAction reads a policy override, as configured.
+func ParseAction(name string) (Action, bool) {
+	for action := NXDomain; action <= Disabled; action++ {
+		if action != LocalData && action.String() == name {
+			return action, true
+		}
+	}
+	return 0, false
+}
+
+// The labels that tell triggers apart, below the zone's name.
+const (
+	clientIPLabel = "rpz-client-ip"
+	ipLabel       = "rpz-ip"
+	nsdnameLabel  = "rpz-nsdname"
+	nsipLabel     = "rpz-nsip"
+)
+
+type policy struct {
+	action Action
+	// The trigger, as found in the zone, for logs.
+	owner string
+	data  []dns.RR
+}
+
+// names holds policies triggered by names: exact ones, and wildcards, which
+// only match subdomains.
+type names struct {
+	exact    map[string]*policy
+	wildcard map[string]*policy
+}
+
+func (n *names) add(name string, p *policy) {
+	if strings.HasPrefix(name, "*.") {
+		if n.wildcard == nil {
+			n.wildcard = map[string]*policy{}
+		}
+		n.wildcard[name[2:]] = p
+		return
+	}
+	if n.exact == nil {
+		n.exact = map[string]*policy{}
+	}
+	n.exact[name] = p
+}
+
+// match finds the policy for name: an exact one, or else the closest
+// wildcard.
+func (n *names) match(name string) *policy {
+	name = dns.Fqdn(strings.ToLower(name))
+	if p, ok := n.exact[name]; ok {
+		return p
+	}
+	for offset, end := dns.NextLabel(name, 0); !end; offset, end = dns.NextLabel(name, offset) {
+		if p, ok := n.wildcard[name[offset:]]; ok {
+			return p
+		}
+	}
+	return nil
+}
+
+// networks holds policies triggered by addresses. The longest matching prefix
+// wins.
+type networks struct {
+	v4 prefixes
+	v6 prefixes
+}
+
+type prefixes struct {
+	// Prefix lengths in use, longest first
+	lengths []int
+	byKey   map[string]*policy
+}
+
+func (n *networks) add(network *net.IPNet, p *policy) {
+	if network.IP.To4() != nil {
+		n.v4.add(network, p)
+	} else {
+		n.v6.add(network, p)
+	}
+}
+
+func (n *networks) match(ip net.IP) *policy {
+	if v4 := ip.To4(); v4 != nil {
+		return n.v4.match(v4, 32)
+	}
+	return n.v6.match(ip, 128)
+}
+
+func (n *prefixes) add(network *net.IPNet, p *policy) {
+	if n.byKey == nil {
+		n.byKey = map[string]*policy{}
+	}
+	n.byKey[network.String()] = p
+	length, _ := network.Mask.Size()
+	idx := sort.Search(len(n.lengths), func(i int) bool { return n.lengths[i] <= length })
+	if idx < len(n.lengths) && n.lengths[idx] == length {
+		return
+	}
+	n.lengths = append(n.lengths, 0)
+	copy(n.lengths[idx+1:], n.lengths[idx:])
+	n.lengths[idx] = length
+}
+
+func (n *prefixes) match(ip net.IP, bits int) *policy {
+	for _, length := range n.lengths {
+		mask := net.CIDRMask(length, bits)
+		network := &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+		if p, ok := n.byKey[network.String()]; ok {
+			return p
+		}
+	}
+	return nil
+}
+
+// zone holds the policies of a response policy zone, by trigger.
+type zone struct {
+	name     string
+	soa      *dns.SOA
+	serial   uint32
+	refresh  uint32
+	qname    names
+	nsdname  names
+	clientIP networks
+	ip       networks
+	// Triggers we do not support, or make no sense of
+	skipped int
+}
+
+// answerTriggers tells whether the zone has policies triggered by answers.
+func (z *zone) answerTriggers() bool {
+	return len(z.ip.v4.lengths) > 0 || len(z.ip.v6.lengths) > 0 || len(z.nsdname.exact) > 0 || len(z.nsdname.wildcard) > 0
+}
+
+// parseZone reads a zone in master file format.
+func parseZone(name string, reader io.Reader, file string) (*zone, error) {
+	parser := dns.NewZoneParser(reader, name, file)
+	var rrs []dns.RR
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+	return newZone(name, rrs)
+}
+
+func readZone(name string, path string) (*zone, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseZone(name, file, path)
+}
+
+// transferZone asks primary for the zone (AXFR).
+func transferZone(name string, primary string) (*zone, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(name)
+	transfer := &dns.Transfer{}
+	envelopes, err := transfer.In(m, primary)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return nil, envelope.Error
+		}
+		rrs = append(rrs, envelope.RR...)
+	}
+	return newZone(name, rrs)
+}
+
+// newZone sorts the records of a zone into policies.
+func newZone(name string, rrs []dns.RR) (*zone, error) {
+	z := &zone{name: name}
+	byOwner := map[string][]dns.RR{}
+	var owners []string
+	for _, rr := range rrs {
+		owner := strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(name, owner) {
+			return nil, fmt.Errorf("%s is not in zone %s", rr.Header().Name, name)
+		}
+		if owner == name {
+			// SOA and NS records
+			if soa, ok := rr.(*dns.SOA); ok {
+				z.soa = soa
+				z.serial = soa.Serial
+				z.refresh = soa.Refresh
+			}
+			continue
+		}
+		if _, ok := byOwner[owner]; !ok {
+			owners = append(owners, owner)
+		}
+		byOwner[owner] = append(byOwner[owner], rr)
+	}
+	for _, owner := range owners {
+		z.add(strings.TrimSuffix(owner, "."+name), newPolicy(owner, byOwner[owner]))
+	}
+	return z, nil
+}
+
+// newPolicy tells special CNAMEs, which stand for actions, from local data.
+func newPolicy(owner string, rrs []dns.RR) *policy {
+	p := &policy{action: LocalData, owner: owner, data: rrs}
+	if cname, ok := rrs[0].(*dns.CNAME); ok && len(rrs) == 1 {
+		switch strings.ToLower(cname.Target) {
+		case ".":
+			p.action = NXDomain
+		case "*.":
+			p.action = NoData
+		case "rpz-passthru.":
+			p.action = Passthru
+		case "rpz-drop.":
+			p.action = Drop
+		case "rpz-tcp-only.":
+			p.action = TCPOnly
+		}
+		if p.action != LocalData {
+			p.data = nil
+		}
+	}
+	return p
+}
+
+// add files a policy under its trigger, given relative to the zone's name.
+func (z *zone) add(trigger string, p *policy) {
+	labels := dns.SplitDomainName(trigger)
+	switch labels[len(labels)-1] {
+	case clientIPLabel, ipLabel:
+		network, err := parseNetwork(labels[:len(labels)-1])
+		if err != nil {
+			z.skipped++
+			return
+		}
+		if labels[len(labels)-1] == clientIPLabel {
+			z.clientIP.add(network, p)
+		} else {
+			z.ip.add(network, p)
+		}
+	case nsdnameLabel:
+		z.nsdname.add(dns.Fqdn(strings.TrimSuffix(trigger, "."+nsdnameLabel)), p)
+	case nsipLabel:
+		z.skipped++
+	default:
+		z.qname.add(dns.Fqdn(trigger), p)
+	}
+}
+
+// parseNetwork reads the reversed notation of IP triggers: the prefix length,
+// then the address, least significant label first, e.g. 24.0.2.0.192 for
+// 192.0.2.0/24, or 48.zz.db8.2001 for 2001:db8::/48.
+func parseNetwork(labels []string) (*net.IPNet, error) {
+	if len(labels) < 2 {
+		return nil, fmt.Errorf("bad address trigger")
+	}
+	prefix, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]string, 0, len(labels)-1)
+	for idx := len(labels) - 1; idx > 0; idx-- {
+		parts = append(parts, labels[idx])
+	}
+	var address string
+	bits := 32
+	if len(parts) == 4 && !strings.Contains(strings.Join(parts, ""), "zz") {
+		address = strings.Join(parts, ".")
+	} else {
+		bits = 128
+		for idx, part := range parts {
+			if part == "zz" {
+				parts[idx] = ""
+			}
+		}
+		address = strings.Join(parts, ":")
+		if strings.HasPrefix(address, ":") {
+			address = ":" + address
+		}
+		if strings.HasSuffix(address, ":") {
+			address = address + ":"
+		}
+	}
+	ip := net.ParseIP(address)
+	if ip == nil || prefix < 1 || prefix > bits || (bits == 32) != (ip.To4() != nil) {
+		return nil, fmt.Errorf("bad address trigger")
+	}
+	mask := net.CIDRMask(prefix, bits)
+	if bits == 32 {
+		ip = ip.To4()
+	}
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
@@ -0,0 +1,99 @@
+package rules
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Action is one step of what a rule does, e.g. "ttl 60" or "rewrite 10.0.0.1".
+// A rule may carry several actions, separated by ";", but only one of them
+// may be terminal: it decides what the answer is.
+type Action struct {
+	Name string
+	Args []string
+	// For "ttl"
+	TTL uint32
+}
+
+var terminalActions = map[string]bool{
+	"nxdomain":      true,
+	"refuse":        true,
+	"servfail":      true,
+	"noerror-empty": true,
+	"drop":          true,
+	"noresponse":    true,
+	"rewrite":       true,
+	"cname":         true,
+}
+
+func (a Action) Terminal() bool {
+	return terminalActions[a.Name]
+}
+
+func (a Action) String() string {
+	return strings.TrimSpace(a.Name + " " + strings.Join(a.Args, " "))
+}
+
+// ParseActions parses a rule's action, e.g. "ttl 60; log; rewrite 10.0.0.1"
+func ParseActions(text string) ([]Action, error) {
+	var actions []Action
+	terminal := ""
+	for _, part := range strings.Split(text, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		action := Action{Name: strings.ToLower(fields[0])}
+		for _, field := range fields[1:] {
+			for _, arg := range strings.Split(field, ",") {
+				if arg = unquote(arg); arg != "" {
+					action.Args = append(action.Args, arg)
+				}
+			}
+		}
+		switch action.Name {
+		case "nxdomain", "refuse", "servfail", "noerror-empty", "drop", "noresponse", "log", "inspect":
+			if len(action.Args) > 0 {
+				return nil, fmt.Errorf("'%s' takes no argument", action.Name)
+			}
+		case "rewrite":
+			if len(action.Args) == 0 {
+				return nil, fmt.Errorf("'rewrite' needs at least one address")
+			}
+			for _, arg := range action.Args {
+				if net.ParseIP(arg) == nil {
+					return nil, fmt.Errorf("'rewrite': bad address '%s'", arg)
+				}
+			}
+		case "cname", "tag":
+			if len(action.Args) != 1 {
+				return nil, fmt.Errorf("'%s' takes one argument", action.Name)
+			}
+		case "ttl":
+			if len(action.Args) != 1 {
+				return nil, fmt.Errorf("'ttl' takes one argument")
+			}
+			ttl, err := strconv.ParseUint(action.Args[0], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("'ttl': bad value '%s'", action.Args[0])
+			}
+			action.TTL = uint32(ttl)
+		default:
+			return nil, fmt.Errorf("unknown action '%s'", action.Name)
+		}
+		if action.Terminal() {
+			if terminal != "" {
+				return nil, fmt.Errorf("'%s' and '%s' both decide the answer", terminal, action.Name)
+			}
+			terminal = action.Name
+		}
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+func unquote(str string) string {
+	return strings.Trim(str, `'"`)
+}
@@ -0,0 +1,41 @@
+package rules
+
+import (
+	"net"
+	"path"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ListMatcher looks values up in named lists, such as domain or network
+// lists.
+type ListMatcher interface {
+	Contains(list string, value string) bool
+}
+
+// inCIDR tells whether ip belongs to the network, e.g.
+// inCIDR(remoteip, "10.0.0.0/8")
+func inCIDR(ip string, network string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	_, cidr, err := net.ParseCIDR(network)
+	if err != nil {
+		return false
+	}
+	return cidr.Contains(parsed)
+}
+
+// matchesGlob matches a name against a shell pattern, regardless of case,
+// e.g. matchesGlob(host, "*.ads.*")
+func matchesGlob(name string, pattern string) bool {
+	matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name))
+	return matched
+}
+
+// labelCount counts the labels of a name, the root aside.
+func labelCount(name string) int {
+	return dns.CountLabel(dns.Fqdn(name))
+}
@@ -0,0 +1,157 @@
+// Package rules compiles the rule engine's conditions once, when the
+// configuration is loaded, and evaluates them for every query.
+package rules
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/antonmedv/expr"
+	"github.com/antonmedv/expr/vm"
+	"github.com/fusion/kittendns/config"
+)
+
+// Env declares what conditions may refer to, and of which type. Every query
+// gets its own copy, with actual values.
+func Env() map[string]interface{} {
+	return map[string]interface{}{
+		// The query
+		"host":   "",
+		"qtype":  "",
+		"qclass": "",
+		// Origin of the zone we are authoritative for, if any
+		"zone": "",
+
+		// The client
+		"remoteip":     "",
+		"clientnet":    "",
+		"ecs":          "",
+		"verified":     false,
+		"tsig":         "",
+		"transport":    "",
+		"listener":     "",
+		"listenername": "",
+		// Name of the view the client sees
+		"view": "",
+
+		// The candidate answer
+		"answertype":   "",
+		"answerip":     "",
+		"answertarget": "",
+		"answerttl":    0,
+
+		// Local time
+		"hour":    0,
+		"minute":  0,
+		"weekday": "",
+
+		// Labels given by the rules that already matched
+		"tags": []string{},
+
+		"inCIDR":      inCIDR,
+		"matchesGlob": matchesGlob,
+		"labelCount":  labelCount,
+		"inList":      func(value string, list string) bool { return false },
+	}
+}
+
+const (
+	QueryPhase  = "query"
+	AnswerPhase = "answer"
+)
+
+type Rule struct {
+	*config.Rule
+	Actions []Action
+	program *vm.Program
+}
+
+type Engine struct {
+	rules []Rule
+	vms   sync.Pool
+	lists ListMatcher
+}
+
+func init() {
+	// Bad rules are as fatal as any other configuration error.
+	config.RegisterCheck(func(cfg *config.Config) error {
+		if _, err := Compile(cfg.Rule); err != nil {
+			return err
+		}
+		for _, view := range cfg.View {
+			if _, err := Compile(view.Rule); err != nil {
+				return fmt.Errorf("view %s: %s", view.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Compile checks and compiles every rule. A rule whose condition is not a
+// valid boolean expression over Env is an error.
+func Compile(rules []config.Rule) (*Engine, error) {
+	engine := &Engine{
+		vms: sync.Pool{New: func() interface{} { return &vm.VM{} }},
+	}
+	for idx := range rules {
+		program, err := expr.Compile(rules[idx].Condition, expr.Env(Env()), expr.AsBool())
+		if err != nil {
+			return nil, fmt.Errorf("bad rule '%s': %s", rules[idx].Condition, err)
+		}
+		switch rules[idx].Phase {
+		case "":
+			rules[idx].Phase = AnswerPhase
+		case QueryPhase, AnswerPhase:
+		default:
+			return nil, fmt.Errorf("bad rule '%s': unknown phase '%s'", rules[idx].Condition, rules[idx].Phase)
+		}
+		actions, err := ParseActions(rules[idx].Action)
+		if err != nil {
+			return nil, fmt.Errorf("bad rule '%s': %s", rules[idx].Condition, err)
+		}
+		engine.rules = append(engine.rules, Rule{Rule: &rules[idx], Actions: actions, program: program})
+	}
+	return engine, nil
+}
+
+// SetLists gives inList() the lists to look values up in.
+func (e *Engine) SetLists(lists ListMatcher) {
+	e.lists = lists
+}
+
+// Env returns an environment for a query, to be filled with its values.
+func (e *Engine) Env() map[string]interface{} {
+	env := Env()
+	env["inList"] = e.inList
+	return env
+}
+
+// inList tells whether value is in the named list, e.g.
+// inList(host, "ads")
+func (e *Engine) inList(value string, list string) bool {
+	if e.lists == nil {
+		return false
+	}
+	return e.lists.Contains(list, value)
+}
+
+// Match returns the first rule of the phase whose condition holds in env, if
+// any.
+func (e *Engine) Match(phase string, env map[string]interface{}) (*Rule, error) {
+	machine := e.vms.Get().(*vm.VM)
+	defer e.vms.Put(machine)
+	for idx := range e.rules {
+		rule := &e.rules[idx]
+		if rule.Phase != phase {
+			continue
+		}
+		out, err := machine.Run(rule.program, env)
+		if err != nil {
+			return nil, fmt.Errorf("rule '%s': %s", rule.Condition, err)
+		}
+		if matched, _ := out.(bool); matched {
+			return rule, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,141 @@
+package rules
+
+import (
+	"testing"
+
+	"github.com/fusion/kittendns/config"
+)
+
+func TestCompile(t *testing.T) {
+	for _, condition := range []string{
+		"host startsWith",
+		"unknown == 'x'",
+		"host",
+	} {
+		if _, err := Compile([]config.Rule{{Condition: condition}}); err == nil {
+			t.Errorf("Expected '%s' to be rejected", condition)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	engine, err := Compile([]config.Rule{
+		{Condition: "remoteip == '192.168.1.19'", Action: "inspect"},
+		{Condition: "host startsWith 'google.'", Action: "drop"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := Env()
+	env["host"] = "google.com."
+	env["remoteip"] = "192.168.1.20"
+	rule, err := engine.Match(AnswerPhase, env)
+	if err != nil || rule == nil || rule.Action != "drop" {
+		t.Errorf("Expected the second rule to match, got %v (%v)", rule, err)
+	}
+	env["host"] = "example.com."
+	if rule, _ := engine.Match(AnswerPhase, env); rule != nil {
+		t.Errorf("Expected no rule to match, got %v", rule)
+	}
+}
+
+type fakeLists map[string][]string
+
+func (l fakeLists) Contains(list string, value string) bool {
+	for _, known := range l[list] {
+		if known == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHelpers(t *testing.T) {
+	engine, err := Compile([]config.Rule{
+		{Condition: "inCIDR(remoteip, '10.0.0.0/8')", Action: "tag cidr"},
+		{Condition: "matchesGlob(host, '*.ads.*')", Action: "tag glob"},
+		{Condition: "labelCount(host) > 4", Action: "tag labels"},
+		{Condition: "inList(host, 'blocked') and qtype == 'AAAA'", Action: "tag list"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.SetLists(fakeLists{"blocked": {"blocked.example.com."}})
+
+	for _, test := range []struct {
+		host     string
+		remoteip string
+		qtype    string
+		action   string
+	}{
+		{"example.com.", "10.1.2.3", "A", "cidr"},
+		{"x.ADS.example.com.", "192.168.1.1", "A", "glob"},
+		{"a.b.c.d.example.com.", "192.168.1.1", "A", "labels"},
+		{"blocked.example.com.", "192.168.1.1", "AAAA", "list"},
+		{"blocked.example.com.", "192.168.1.1", "A", ""},
+	} {
+		env := engine.Env()
+		env["host"] = test.host
+		env["remoteip"] = test.remoteip
+		env["qtype"] = test.qtype
+		rule, err := engine.Match(AnswerPhase, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		action := ""
+		if rule != nil {
+			action = rule.Actions[0].Args[0]
+		}
+		if action != test.action {
+			t.Errorf("%s from %s: expected '%s', got '%s'", test.host, test.remoteip, test.action, action)
+		}
+	}
+}
+
+func TestParseActions(t *testing.T) {
+	actions, err := ParseActions("ttl 60; log; tag ads ;rewrite '10.0.0.1', fe80::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 4 || actions[0].TTL != 60 || actions[2].Args[0] != "ads" {
+		t.Errorf("Unexpected actions %v", actions)
+	}
+	if rewrite := actions[3]; !rewrite.Terminal() || len(rewrite.Args) != 2 || rewrite.Args[1] != "fe80::1" {
+		t.Errorf("Unexpected rewrite %v", rewrite)
+	}
+
+	for _, bad := range []string{
+		"nxdomain; refuse",
+		"rewrite",
+		"rewrite example.com",
+		"ttl soon",
+		"explode",
+		"cname",
+	} {
+		if _, err := ParseActions(bad); err == nil {
+			t.Errorf("Expected '%s' to be rejected", bad)
+		}
+	}
+}
+
+func TestPhases(t *testing.T) {
+	engine, err := Compile([]config.Rule{
+		{Condition: "host == 'ads.example.com.'", Action: "nxdomain", Phase: "query"},
+		{Condition: "answerip == '10.0.0.1'", Action: "refuse"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := engine.Env()
+	env["host"] = "ads.example.com."
+	env["answerip"] = "10.0.0.1"
+	if rule, _ := engine.Match(QueryPhase, env); rule == nil || rule.Action != "nxdomain" {
+		t.Errorf("Expected the query phase rule to match, got %v", rule)
+	}
+	if rule, _ := engine.Match(AnswerPhase, env); rule == nil || rule.Action != "refuse" {
+		t.Errorf("Expected the answer phase rule to match, got %v", rule)
+	}
+	if _, err := Compile([]config.Rule{{Condition: "true", Phase: "later"}}); err == nil {
+		t.Error("Expected an unknown phase to be rejected")
+	}
+}
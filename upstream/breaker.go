@@ -0,0 +1,158 @@
+package upstream
+
+import (
+	"log"
+	"time"
+
+	"github.com/fusion/kittendns/metrics"
+)
+
+type BreakerState int
+
+const (
+	// Queries flow to the upstream.
+	Closed BreakerState = iota
+	// The upstream failed too often: queries fail fast instead of waiting
+	// for it to time out.
+	Open
+	// A few trial queries find out whether the upstream is back.
+	HalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+const (
+	defaultWindowFailures = 5
+	defaultFailureWindow  = 30 * time.Second
+	defaultHalfOpenTrials = 1
+)
+
+// breaker is an upstream's circuit breaker. It is protected by the
+// upstream's lock.
+type breaker struct {
+	state BreakerState
+	// Failures since the last success.
+	consecutive uint32
+	// Recent failures, oldest first.
+	failures []time.Time
+	opened   time.Time
+	// Trial queries in flight, let through while half-open.
+	trials uint32
+}
+
+type breakerSettings struct {
+	// Consecutive failures
+	maxFailures uint32
+	// Failures within the window
+	windowFailures uint32
+	window         time.Duration
+	cooldown       time.Duration
+	trials         uint32
+}
+
+// available tells whether the upstream may be asked, without committing to
+// it.
+func (u *Upstream) available(settings *breakerSettings, now time.Time) bool {
+	u.Lock()
+	defer u.Unlock()
+	switch u.breaker.state {
+	case Open:
+		return now.Sub(u.breaker.opened) >= settings.cooldown
+	case HalfOpen:
+		return u.breaker.trials < settings.trials
+	}
+	return true
+}
+
+// acquire commits to asking the upstream. Once the cooldown is over, an open
+// breaker lets trial queries through. trial tells whether the query is one of
+// them: it must be reported as such, whatever the state is by then.
+func (u *Upstream) acquire(settings *breakerSettings, now time.Time) (ok bool, trial bool) {
+	u.Lock()
+	defer u.Unlock()
+	if u.breaker.state == Open {
+		if now.Sub(u.breaker.opened) < settings.cooldown {
+			return false, false
+		}
+		u.setState(HalfOpen)
+	}
+	if u.breaker.state == HalfOpen {
+		if u.breaker.trials >= settings.trials {
+			return false, false
+		}
+		u.breaker.trials++
+		return true, true
+	}
+	return true, false
+}
+
+func (u *Upstream) fail(settings *breakerSettings, now time.Time, trial bool, err error) {
+	u.Lock()
+	defer u.Unlock()
+	if trial {
+		u.breaker.trials--
+	}
+	switch u.breaker.state {
+	case HalfOpen:
+		u.breaker.opened = now
+		u.setState(Open)
+		log.Printf("Upstream %s still failing (%s)\n", u.Address, err)
+	case Closed:
+		u.breaker.consecutive++
+		recent := u.breaker.failures[:0]
+		for _, failure := range u.breaker.failures {
+			if now.Sub(failure) < settings.window {
+				recent = append(recent, failure)
+			}
+		}
+		u.breaker.failures = append(recent, now)
+		if u.breaker.consecutive >= settings.maxFailures {
+			u.open(now)
+			log.Printf("Upstream %s taken out of rotation after %d failures (%s)\n", u.Address, settings.maxFailures, err)
+		} else if uint32(len(u.breaker.failures)) >= settings.windowFailures {
+			u.open(now)
+			log.Printf("Upstream %s failed %d times in %s (%s)\n", u.Address, settings.windowFailures, settings.window, err)
+		}
+	}
+}
+
+func (u *Upstream) open(now time.Time) {
+	u.breaker.opened = now
+	u.breaker.consecutive = 0
+	u.breaker.failures = nil
+	u.setState(Open)
+}
+
+func (u *Upstream) succeed(trial bool) {
+	u.Lock()
+	defer u.Unlock()
+	if trial {
+		u.breaker.trials--
+	}
+	u.breaker.consecutive = 0
+	if u.breaker.state != Closed {
+		u.breaker.failures = nil
+		u.setState(Closed)
+	}
+}
+
+func (u *Upstream) setState(state BreakerState) {
+	u.breaker.state = state
+	log.Printf("Upstream %s circuit %s\n", u.Address, state)
+	metrics.SetBreakerState(u.Address, state.String())
+}
+
+// State returns the state of the upstream's circuit breaker.
+func (u *Upstream) State() BreakerState {
+	u.Lock()
+	defer u.Unlock()
+	return u.breaker.state
+}
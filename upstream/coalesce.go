@@ -0,0 +1,75 @@
+package upstream
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Coalescer folds identical queries that are in flight at the same time into
+// a single upstream exchange. Everyone waiting gets their own copy of the answer.
+type Coalescer struct {
+	sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	wg  sync.WaitGroup
+	msg *dns.Msg
+	err error
+	// Callers waiting for the result, besides the one running the call.
+	waiters int
+}
+
+// Key identifies a question regardless of the 0x20 casing it was asked with.
+func Key(q dns.Question) string {
+	return fmt.Sprintf("%s/%d/%d", strings.ToLower(q.Name), q.Qtype, q.Qclass)
+}
+
+// Do runs fn, unless a call for the same key is already running, in which case
+// it waits for that call's result instead. shared reports whether the
+// result came from another caller's exchange.
+func (c *Coalescer) Do(key string, fn func() (*dns.Msg, error)) (msg *dns.Msg, shared bool, err error) {
+	c.Lock()
+	if c.calls == nil {
+		c.calls = make(map[string]*call)
+	}
+	if inflight, ok := c.calls[key]; ok {
+		inflight.waiters++
+		c.Unlock()
+		inflight.wg.Wait()
+		return copyMsg(inflight.msg), true, inflight.err
+	}
+	inflight := new(call)
+	inflight.wg.Add(1)
+	c.calls[key] = inflight
+	c.Unlock()
+
+	inflight.msg, inflight.err = fn()
+
+	c.Lock()
+	delete(c.calls, key)
+	c.Unlock()
+	inflight.wg.Done()
+
+	return copyMsg(inflight.msg), false, inflight.err
+}
+
+// waiting tells how many callers wait for the call running for key.
+func (c *Coalescer) waiting(key string) int {
+	c.Lock()
+	defer c.Unlock()
+	if inflight, ok := c.calls[key]; ok {
+		return inflight.waiters
+	}
+	return 0
+}
+
+func copyMsg(msg *dns.Msg) *dns.Msg {
+	if msg == nil {
+		return nil
+	}
+	return msg.Copy()
+}
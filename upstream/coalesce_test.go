@@ -0,0 +1,57 @@
+package upstream
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCoalescedExchange(t *testing.T) {
+	c := &Coalescer{}
+	var exchanges int32
+	release := make(chan struct{})
+
+	q := dns.Question{Name: "Example.COM.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	other := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	if Key(q) != Key(other) {
+		t.Fatalf("Keys should ignore casing: %s != %s", Key(q), Key(other))
+	}
+
+	var wg sync.WaitGroup
+	results := make([]*dns.Msg, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg, _, err := c.Do(Key(q), func() (*dns.Msg, error) {
+				atomic.AddInt32(&exchanges, 1)
+				<-release
+				m := new(dns.Msg)
+				m.SetQuestion(q.Name, q.Qtype)
+				return m, nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = msg
+		}(i)
+	}
+	// Everyone else joins the first exchange before it is answered.
+	for c.waiting(Key(q)) < len(results)-1 {
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+
+	if exchanges != 1 {
+		t.Errorf("Expected a single upstream exchange, got %d", exchanges)
+	}
+	for i := 1; i < len(results); i++ {
+		if results[i] == results[0] {
+			t.Fatal("Callers should not share the same message")
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fusion/kittendns/config"
+	"github.com/fusion/kittendns/metrics"
+	"github.com/miekg/dns"
+)
+
+type Strategy int
+
+const (
+	Sequential Strategy = iota
+	Random
+	RoundRobin
+	Fastest
+)
+
+const (
+	defaultTimeout       = 2 * time.Second
+	defaultMaxFailures   = 3
+	defaultProbeInterval = 10 * time.Second
+	defaultCooldown      = 10 * time.Second
+)
+
+var (
+	ErrNoUpstream = errors.New("no upstream available")
+	// Every upstream's circuit is open: we did not even try.
+	ErrCircuitOpen = errors.New("all upstream circuits open")
+)
+
+func ParseStrategy(name string) (Strategy, error) {
+	switch strings.ToLower(name) {
+	case "", "sequential", "failover":
+		return Sequential, nil
+	case "random":
+		return Random, nil
+	case "roundrobin", "round-robin":
+		return RoundRobin, nil
+	case "fastest", "latency":
+		return Fastest, nil
+	}
+	return Sequential, fmt.Errorf("unknown upstream strategy '%s'", name)
+}
+
+type Upstream struct {
+	sync.Mutex
+	Address   string
+	Timeout   time.Duration
+	transport transport
+	breaker   breaker
+	// Smoothed round trip time, 0 until measured.
+	rtt time.Duration
+}
+
+type tsig struct {
+	key       string
+	secret    string
+	algorithm string
+}
+
+// Pool spreads queries over a set of upstreams, according to its strategy,
+// and keeps track of which ones are worth asking.
+type Pool struct {
+	upstreams []*Upstream
+	strategy  Strategy
+	recursion bool
+	breaker   breakerSettings
+	next      uint32
+	now       func() time.Time
+	done      chan struct{}
+}
+
+func NewPool(parent config.Parent) (*Pool, error) {
+	strategy, err := ParseStrategy(parent.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	timeout := defaultTimeout
+	if parent.Timeout > 0 {
+		timeout = time.Duration(parent.Timeout) * time.Millisecond
+	}
+	pool := &Pool{
+		strategy:  strategy,
+		recursion: !parent.NoRecursion,
+		breaker: breakerSettings{
+			maxFailures:    defaultMaxFailures,
+			windowFailures: defaultWindowFailures,
+			window:         defaultFailureWindow,
+			cooldown:       defaultCooldown,
+			trials:         defaultHalfOpenTrials,
+		},
+		now:  time.Now,
+		done: make(chan struct{}),
+	}
+	if parent.MaxFailures > 0 {
+		pool.breaker.maxFailures = parent.MaxFailures
+	}
+	if parent.WindowFailures > 0 {
+		pool.breaker.windowFailures = parent.WindowFailures
+	}
+	if parent.FailureWindow > 0 {
+		pool.breaker.window = time.Duration(parent.FailureWindow) * time.Second
+	}
+	if parent.Cooldown > 0 {
+		pool.breaker.cooldown = time.Duration(parent.Cooldown) * time.Second
+	}
+	if parent.HalfOpenTrials > 0 {
+		pool.breaker.trials = parent.HalfOpenTrials
+	}
+	net := "udp"
+	if parent.TCPOnly {
+		net = "tcp"
+	}
+	var signer *tsig
+	if parent.TsigKey != "" {
+		signer = &tsig{key: parent.TsigKey, secret: parent.TsigSecret, algorithm: dns.HmacSHA256}
+		if parent.TsigAlgorithm != "" {
+			signer.algorithm = dns.Fqdn(strings.ToLower(parent.TsigAlgorithm))
+		}
+	}
+	for _, definition := range parent.Upstream {
+		transport, err := newTransport(definition, net, signer)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %s", definition.Address, err)
+		}
+		upstream := &Upstream{Address: definition.Address, Timeout: timeout, transport: transport}
+		if definition.Timeout > 0 {
+			upstream.Timeout = time.Duration(definition.Timeout) * time.Millisecond
+		}
+		pool.upstreams = append(pool.upstreams, upstream)
+	}
+	if len(pool.upstreams) == 0 {
+		return nil, ErrNoUpstream
+	}
+	probeInterval := defaultProbeInterval
+	if parent.ProbeInterval > 0 {
+		probeInterval = time.Duration(parent.ProbeInterval) * time.Second
+	}
+	go pool.probe(probeInterval)
+	return pool, nil
+}
+
+// Close stops probing, and forgets the pool's upstreams, which are no longer
+// reported on. The pool must not be used afterwards.
+func (p *Pool) Close() {
+	close(p.done)
+	for _, upstream := range p.upstreams {
+		metrics.Breakers.Delete(upstream.Address)
+	}
+}
+
+// Exchange sends m to the upstreams, in the order picked by the strategy,
+// until one of them answers. It returns the address of the one that did.
+// Upstreams whose circuit is open are skipped: if none is left, we fail
+// fast with ErrCircuitOpen.
+func (p *Pool) Exchange(m *dns.Msg) (*dns.Msg, string, error) {
+	m.RecursionDesired = p.recursion
+	err := ErrCircuitOpen
+	for _, upstream := range p.candidates() {
+		ok, trial := upstream.acquire(&p.breaker, p.now())
+		if !ok {
+			continue
+		}
+		var response *dns.Msg
+		var rtt time.Duration
+		response, rtt, err = upstream.exchange(m)
+		if err != nil {
+			upstream.fail(&p.breaker, p.now(), trial, err)
+			continue
+		}
+		p.succeeded(upstream, trial, rtt)
+		return response, upstream.Address, nil
+	}
+	return nil, "", err
+}
+
+func (u *Upstream) exchange(m *dns.Msg) (*dns.Msg, time.Duration, error) {
+	return u.transport.exchange(m, u.Timeout)
+}
+
+// candidates lists the upstreams that may be asked, in the order they should
+// be tried.
+func (p *Pool) candidates() []*Upstream {
+	now := p.now()
+	healthy := make([]*Upstream, 0, len(p.upstreams))
+	for _, upstream := range p.upstreams {
+		if upstream.available(&p.breaker, now) {
+			healthy = append(healthy, upstream)
+		}
+	}
+	if len(healthy) == 0 {
+		return healthy
+	}
+
+	switch p.strategy {
+	case Random:
+		rand.Shuffle(len(healthy), func(i, j int) {
+			healthy[i], healthy[j] = healthy[j], healthy[i]
+		})
+	case RoundRobin:
+		start := int(atomic.AddUint32(&p.next, 1)-1) % len(healthy)
+		healthy = append(healthy[start:], healthy[:start]...)
+	case Fastest:
+		rtts := make(map[*Upstream]time.Duration, len(healthy))
+		for _, upstream := range healthy {
+			upstream.Lock()
+			rtts[upstream] = upstream.rtt
+			upstream.Unlock()
+		}
+		// Unmeasured upstreams come first, so that they get measured.
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return rtts[healthy[i]] < rtts[healthy[j]]
+		})
+	}
+	return healthy
+}
+
+func (p *Pool) succeeded(upstream *Upstream, trial bool, rtt time.Duration) {
+	upstream.succeed(trial)
+	upstream.Lock()
+	defer upstream.Unlock()
+	if upstream.rtt == 0 {
+		upstream.rtt = rtt
+	} else {
+		upstream.rtt = (upstream.rtt*7 + rtt) / 8
+	}
+}
+
+// probe regularly checks on the upstreams whose circuit is open, to bring
+// them back as soon as they answer again, without waiting for trial queries.
+func (p *Pool) probe(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			for _, upstream := range p.upstreams {
+				if upstream.State() != Open {
+					continue
+				}
+				probeM := new(dns.Msg)
+				probeM.SetQuestion(".", dns.TypeNS)
+				if _, rtt, err := upstream.exchange(probeM); err == nil {
+					log.Printf("Upstream %s answered a probe\n", upstream.Address)
+					p.succeeded(upstream, false, rtt)
+				}
+			}
+		}
+	}
+}
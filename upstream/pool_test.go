@@ -0,0 +1,232 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fusion/kittendns/config"
+	"github.com/miekg/dns"
+)
+
+// startServer runs a local server that answers every A query with 127.0.0.2.
+func startServer(t *testing.T) string {
+	return startServerAt(t, "127.0.0.1:0")
+}
+
+func startServerAt(t *testing.T, address string) string {
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 127.0.0.2")
+		m.Answer = []dns.RR{rr}
+		w.WriteMsg(m)
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// deadAddress returns an address nobody listens on.
+func deadAddress(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := pc.LocalAddr().String()
+	pc.Close()
+	return address
+}
+
+func TestFailover(t *testing.T) {
+	live := startServer(t)
+	dead := deadAddress(t)
+
+	pool, err := NewPool(config.Parent{
+		Upstream:    []config.Upstream{{Address: dead}, {Address: live}},
+		Timeout:     200,
+		MaxFailures: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	response, answered, err := pool.Exchange(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answered != live || len(response.Answer) != 1 {
+		t.Errorf("Expected an answer from %s, got %v from %s", live, response.Answer, answered)
+	}
+
+	candidates := pool.candidates()
+	if len(candidates) != 1 || candidates[0].Address != live {
+		t.Errorf("Failing upstream should have been taken out of rotation")
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	first := startServer(t)
+	second := startServer(t)
+
+	pool, err := NewPool(config.Parent{
+		Upstream: []config.Upstream{{Address: first}, {Address: second}},
+		Strategy: "roundrobin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		_, answered, err := pool.Exchange(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[answered]++
+	}
+	if seen[first] != 2 || seen[second] != 2 {
+		t.Errorf("Expected queries to be evenly spread, got %v", seen)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	dead := deadAddress(t)
+
+	pool, err := NewPool(config.Parent{
+		Upstream:    []config.Upstream{{Address: dead}},
+		Timeout:     100,
+		MaxFailures: 2,
+		Cooldown:    5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+	upstream := pool.upstreams[0]
+
+	exchange := func() error {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		_, _, err := pool.Exchange(m)
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if err := exchange(); err == nil || err == ErrCircuitOpen {
+			t.Fatalf("Expected the upstream to be tried, got %v", err)
+		}
+	}
+	if upstream.State() != Open {
+		t.Fatalf("Expected the circuit to be open, got %s", upstream.State())
+	}
+	if err := exchange(); err != ErrCircuitOpen {
+		t.Errorf("Expected to fail fast, got %v", err)
+	}
+
+	// After the cooldown, a trial query goes through, and fails.
+	now = now.Add(5 * time.Second)
+	if err := exchange(); err == nil || err == ErrCircuitOpen {
+		t.Errorf("Expected a trial query, got %v", err)
+	}
+	if upstream.State() != Open {
+		t.Errorf("Expected the circuit to open again, got %s", upstream.State())
+	}
+
+	// Until the upstream comes back.
+	live, _ := newTransport(config.Upstream{Address: startServer(t)}, "udp", nil)
+	upstream.transport = live
+	now = now.Add(5 * time.Second)
+	if err := exchange(); err != nil {
+		t.Errorf("Expected the trial query to succeed, got %v", err)
+	}
+	if upstream.State() != Closed {
+		t.Errorf("Expected the circuit to be closed, got %s", upstream.State())
+	}
+}
+
+func TestHalfOpenTrials(t *testing.T) {
+	pool, err := NewPool(config.Parent{
+		Upstream:       []config.Upstream{{Address: deadAddress(t)}},
+		Timeout:        100,
+		MaxFailures:    1,
+		Cooldown:       5,
+		HalfOpenTrials: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+	upstream := pool.upstreams[0]
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	pool.Exchange(m)
+
+	for round := 0; round < 2; round++ {
+		now = now.Add(5 * time.Second)
+		// Both trials are let through, then both fail.
+		first, firstTrial := upstream.acquire(&pool.breaker, now)
+		second, secondTrial := upstream.acquire(&pool.breaker, now)
+		if !first || !second || !firstTrial || !secondTrial {
+			t.Fatalf("Round %d: expected two trial queries", round)
+		}
+		if third, _ := upstream.acquire(&pool.breaker, now); third {
+			t.Fatalf("Round %d: expected no more than two trial queries", round)
+		}
+		upstream.fail(&pool.breaker, now, true, ErrNoUpstream)
+		upstream.fail(&pool.breaker, now, true, ErrNoUpstream)
+		if upstream.State() != Open {
+			t.Errorf("Round %d: expected the circuit to open again, got %s", round, upstream.State())
+		}
+		if upstream.breaker.trials != 0 {
+			t.Fatalf("Round %d: %d trials left in flight", round, upstream.breaker.trials)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	dead := deadAddress(t)
+	pool, err := NewPool(config.Parent{
+		Upstream:      []config.Upstream{{Address: dead}},
+		Timeout:       100,
+		MaxFailures:   1,
+		ProbeInterval: 1,
+		Cooldown:      3600,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	pool.Exchange(m)
+	upstream := pool.upstreams[0]
+	if upstream.State() != Open {
+		t.Fatalf("Expected the circuit to be open, got %s", upstream.State())
+	}
+
+	// Probes find out that the upstream is back, long before the cooldown is
+	// over.
+	startServerAt(t, dead)
+	deadline := time.Now().Add(3 * time.Second)
+	for upstream.State() != Closed && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if upstream.State() != Closed {
+		t.Errorf("Expected a probe to close the circuit, got %s", upstream.State())
+	}
+}
@@ -0,0 +1,242 @@
+package upstream
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fusion/kittendns/config"
+	"github.com/miekg/dns"
+)
+
+const (
+	// Idle encrypted connections are kept around for reuse, but servers tend
+	// to close them after a few seconds anyway.
+	maxIdleConns   = 8
+	maxIdleTimeout = 20 * time.Second
+
+	// EDNS buffer size advertised to upstreams.
+	udpSize = 1232
+)
+
+// A transport carries a query to an upstream and brings its answer back.
+type transport interface {
+	exchange(m *dns.Msg, timeout time.Duration) (*dns.Msg, time.Duration, error)
+}
+
+func newTransport(definition config.Upstream, net string, signer *tsig) (transport, error) {
+	switch {
+	case strings.HasPrefix(definition.Address, "tls://"):
+		address := strings.TrimPrefix(definition.Address, "tls://")
+		tlsConfig, err := newTLSConfig(definition, address)
+		if err != nil {
+			return nil, err
+		}
+		return &tlsTransport{address: address, tlsConfig: tlsConfig, tsig: signer}, nil
+	case strings.HasPrefix(definition.Address, "https://"):
+		endpoint, err := url.Parse(definition.Address)
+		if err != nil {
+			return nil, err
+		}
+		if signer != nil {
+			return nil, errors.New("TSIG is not supported over HTTPS")
+		}
+		tlsConfig, err := newTLSConfig(definition, endpoint.Host)
+		if err != nil {
+			return nil, err
+		}
+		return &httpsTransport{
+			endpoint: endpoint.String(),
+			client: &http.Client{Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				TLSClientConfig:     tlsConfig,
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: maxIdleConns,
+				IdleConnTimeout:     maxIdleTimeout,
+			}},
+		}, nil
+	}
+	return &plainTransport{address: definition.Address, net: net, tsig: signer}, nil
+}
+
+func newTLSConfig(definition config.Upstream, address string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: definition.ServerName}
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		tlsConfig.ServerName = host
+	}
+	if definition.CAFile != "" {
+		pem, err := os.ReadFile(definition.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", definition.CAFile)
+		}
+	}
+	return tlsConfig, nil
+}
+
+func sign(client *dns.Client, m *dns.Msg, signer *tsig) *dns.Msg {
+	if signer == nil {
+		return m
+	}
+	// Signing appends to the message, which may be sent to several upstreams.
+	m = m.Copy()
+	m.SetTsig(signer.key, signer.algorithm, 300, time.Now().Unix())
+	client.TsigSecret = map[string]string{signer.key: signer.secret}
+	return m
+}
+
+// Good old DNS over UDP or TCP.
+type plainTransport struct {
+	address string
+	net     string
+	tsig    *tsig
+}
+
+func (t *plainTransport) exchange(m *dns.Msg, timeout time.Duration) (*dns.Msg, time.Duration, error) {
+	if m.IsEdns0() == nil {
+		m = m.Copy()
+		m.SetEdns0(udpSize, false)
+	}
+	client := &dns.Client{Net: t.net, Timeout: timeout}
+	m = sign(client, m, t.tsig)
+	response, rtt, err := client.Exchange(m, t.address)
+	if err == nil && response.Truncated && t.net == "udp" {
+		// Did not fit: ask again, over TCP this time.
+		client.Net = "tcp"
+		response, rtt, err = client.Exchange(m, t.address)
+	}
+	return response, rtt, err
+}
+
+// DNS over TLS (RFC 7858). Connections are kept open between queries.
+type tlsTransport struct {
+	sync.Mutex
+	address   string
+	tlsConfig *tls.Config
+	tsig      *tsig
+	idle      []*idleConn
+}
+
+type idleConn struct {
+	conn  *dns.Conn
+	since time.Time
+}
+
+func (t *tlsTransport) exchange(m *dns.Msg, timeout time.Duration) (*dns.Msg, time.Duration, error) {
+	client := &dns.Client{Net: "tcp-tls", Timeout: timeout, TLSConfig: t.tlsConfig}
+	m = sign(client, m, t.tsig)
+
+	// A connection that sat idle may have been closed on the other end:
+	// in this case, we get one more chance with a brand new one.
+	if conn := t.get(); conn != nil {
+		response, rtt, err := client.ExchangeWithConn(m, conn)
+		if err == nil {
+			t.put(conn)
+			return response, rtt, nil
+		}
+		conn.Close()
+	}
+
+	conn, err := client.Dial(t.address)
+	if err != nil {
+		return nil, 0, err
+	}
+	response, rtt, err := client.ExchangeWithConn(m, conn)
+	if err != nil {
+		conn.Close()
+		return nil, rtt, err
+	}
+	t.put(conn)
+	return response, rtt, nil
+}
+
+func (t *tlsTransport) get() *dns.Conn {
+	t.Lock()
+	defer t.Unlock()
+	for len(t.idle) > 0 {
+		last := t.idle[len(t.idle)-1]
+		t.idle = t.idle[:len(t.idle)-1]
+		if time.Since(last.since) < maxIdleTimeout {
+			return last.conn
+		}
+		last.conn.Close()
+	}
+	return nil
+}
+
+func (t *tlsTransport) put(conn *dns.Conn) {
+	t.Lock()
+	defer t.Unlock()
+	if len(t.idle) >= maxIdleConns {
+		conn.Close()
+		return
+	}
+	t.idle = append(t.idle, &idleConn{conn: conn, since: time.Now()})
+}
+
+// DNS over HTTPS (RFC 8484). The HTTP client takes care of keeping
+// connections alive.
+type httpsTransport struct {
+	endpoint string
+	client   *http.Client
+}
+
+const dnsMessageType = "application/dns-message"
+
+func (t *httpsTransport) exchange(m *dns.Msg, timeout time.Duration) (*dns.Msg, time.Duration, error) {
+	// RFC 8484 recommends a zero ID, which makes answers easier to cache.
+	query := m.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(packed))
+	if err != nil {
+		return nil, 0, err
+	}
+	request.Header.Set("Content-Type", dnsMessageType)
+	request.Header.Set("Accept", dnsMessageType)
+
+	client := *t.client
+	client.Timeout = timeout
+	start := time.Now()
+	httpResponse, err := client.Do(request)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("%s answered with HTTP status %d", t.endpoint, httpResponse.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(httpResponse.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, 0, err
+	}
+	rtt := time.Since(start)
+
+	response := new(dns.Msg)
+	if err := response.Unpack(body); err != nil {
+		return nil, rtt, err
+	}
+	response.Id = m.Id
+	return response, rtt, nil
+}
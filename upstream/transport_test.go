@@ -0,0 +1,234 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fusion/kittendns/config"
+	"github.com/miekg/dns"
+)
+
+func answer(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 127.0.0.3")
+	m.Answer = []dns.RR{rr}
+	return m
+}
+
+// writeCA saves the certificate used by a test server, so that we can trust it.
+func writeCA(t *testing.T, server *httptest.Server) string {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	raw := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(path, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOverHTTPS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Type") != dnsMessageType {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		r := new(dns.Msg)
+		if err := r.Unpack(body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		packed, _ := answer(r).Pack()
+		w.Header().Set("Content-Type", dnsMessageType)
+		w.Write(packed)
+	}))
+	defer server.Close()
+
+	pool, err := NewPool(config.Parent{Upstream: []config.Upstream{{
+		Address:    server.URL + "/dns-query",
+		ServerName: "example.com",
+		CAFile:     writeCA(t, server),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	response, _, err := pool.Exchange(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Id != m.Id || len(response.Answer) != 1 {
+		t.Errorf("Unexpected response %v", response)
+	}
+}
+
+func TestOverTLS(t *testing.T) {
+	// Only borrowing its certificate.
+	certServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer certServer.Close()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certServer.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accepted int32
+	server := &dns.Server{
+		Listener: &countingListener{Listener: listener, accepted: &accepted},
+		Net:      "tcp-tls",
+		Handler: dns.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+			w.WriteMsg(answer(r))
+		}),
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	pool, err := NewPool(config.Parent{Upstream: []config.Upstream{{
+		Address:    "tls://" + listener.Addr().String(),
+		ServerName: "example.com",
+		CAFile:     writeCA(t, certServer),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	for i := 0; i < 3; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		response, _, err := pool.Exchange(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Answer) != 1 {
+			t.Errorf("Unexpected response %v", response)
+		}
+	}
+	if accepted != 1 {
+		t.Errorf("Expected the connection to be reused, got %d connections", accepted)
+	}
+}
+
+type countingListener struct {
+	net.Listener
+	accepted *int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(l.accepted, 1)
+	}
+	return conn, err
+}
+
+func TestTruncatedFallsBackToTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", listener.Addr().String())
+	if err != nil {
+		t.Skip("Unable to listen over UDP and TCP on the same port")
+	}
+	handler := dns.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+		if r.IsEdns0() == nil {
+			t.Error("Expected queries to advertise an EDNS buffer size")
+		}
+		if w.RemoteAddr().Network() == "udp" {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Truncated = true
+			w.WriteMsg(m)
+			return
+		}
+		w.WriteMsg(answer(r))
+	})
+	udpServer := &dns.Server{PacketConn: pc, Handler: handler}
+	tcpServer := &dns.Server{Listener: listener, Handler: handler}
+	go udpServer.ActivateAndServe()
+	go tcpServer.ActivateAndServe()
+	defer udpServer.Shutdown()
+	defer tcpServer.Shutdown()
+
+	pool, err := NewPool(config.Parent{Upstream: []config.Upstream{{Address: listener.Addr().String()}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	response, _, err := pool.Exchange(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Truncated || len(response.Answer) != 1 {
+		t.Errorf("Expected the full answer over TCP, got %v", response)
+	}
+}
+
+func TestSignedWithTSIG(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const key, secret = "transfer.example.", "c2VjcmV0c2VjcmV0c2VjcmV0"
+	signed := make(chan bool, 2)
+	server := &dns.Server{
+		PacketConn: pc,
+		TsigSecret: map[string]string{key: secret},
+		Handler: dns.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+			m := answer(r)
+			if tsig := r.IsTsig(); tsig != nil {
+				signed <- w.TsigStatus() == nil
+				m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+			} else {
+				signed <- false
+			}
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	for _, test := range []struct {
+		secret string
+		valid  bool
+	}{{secret, true}, {"b3RoZXJzZWNyZXQ=", false}} {
+		pool, err := NewPool(config.Parent{
+			Upstream:   []config.Upstream{{Address: pc.LocalAddr().String()}},
+			TsigKey:    key,
+			TsigSecret: test.secret,
+			Timeout:    500,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		_, _, err = pool.Exchange(m)
+		pool.Close()
+		if valid := <-signed; valid != test.valid {
+			t.Errorf("Expected the server to find the signature valid: %v, got %v", test.valid, valid)
+		}
+		if (err == nil) != test.valid {
+			t.Errorf("Expected the exchange to succeed: %v, got %v", test.valid, err)
+		}
+		if m.IsTsig() != nil {
+			t.Error("Expected the query to be signed on a copy")
+		}
+	}
+}
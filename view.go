@@ -0,0 +1,140 @@
+package main
+
+import (
+	"log"
+	"sort"
+
+	"github.com/fusion/kittendns/config"
+	"github.com/fusion/kittendns/rules"
+	"github.com/fusion/kittendns/upstream"
+	"github.com/miekg/dns"
+)
+
+// View is what some clients see: its own zones, rules, forwarding and
+// recursion policy. Without views, everyone sees a single view made of the top
+// level definitions. Views inheriting the top level zones share their records,
+// so that an update through one of them is seen through all of them.
+type View struct {
+	Definition  *config.View
+	Records     *map[uint16]map[string]config.Record
+	Mailers     *map[string][]config.Mailer
+	NameServers *map[string][]config.NameServer
+	Resolver    *Resolver
+	Rules       *rules.Engine
+	Forwarders  []Forwarder
+	pools       []*upstream.Pool
+}
+
+// newViews builds the views, in the order they are tried.
+func (app *App) newViews() []*View {
+	definitions := app.Config.View
+	if len(definitions) == 0 {
+		definitions = []config.View{{
+			Name:    "default",
+			Zone:    app.Config.Zone,
+			Rule:    app.Config.Rule,
+			Forward: app.Config.Forward,
+		}}
+	}
+	views := make([]*View, 0, len(definitions))
+	var inherited *View
+	for idx := range definitions {
+		view := app.newView(&definitions[idx], inherited)
+		if inherited == nil && sameZones(view.Definition.Zone, app.Config.Zone) {
+			inherited = view
+		}
+		views = append(views, view)
+	}
+	return views
+}
+
+// sameZones tells whether a view's zones are the top level ones it inherited,
+// rather than its own.
+func sameZones(zones []config.Zone, top []config.Zone) bool {
+	return len(zones) == len(top) && (len(zones) == 0 || &zones[0] == &top[0])
+}
+
+// newView builds a view. Its records are those of inherited, if any, when
+// both use the top level zones.
+func (app *App) newView(definition *config.View, inherited *View) *View {
+	view := &View{Definition: definition}
+	engine, err := rules.Compile(definition.Rule)
+	if err != nil {
+		log.Fatalf("View %s: %s", definition.Name, err)
+	}
+	engine.SetLists(app.Lists)
+	view.Rules = engine
+	if inherited != nil && sameZones(definition.Zone, app.Config.Zone) {
+		view.NameServers = inherited.NameServers
+		view.Mailers = inherited.Mailers
+		view.Records = inherited.Records
+	} else {
+		view.NameServers = flattenNameServers(definition.Zone)
+		view.Mailers = flattenMailers(definition.Zone)
+		view.Records = flattenRecords(definition.Zone, app.Config.Settings.DebugLevel)
+	}
+	view.Resolver = &Resolver{entries: &map[uint16]map[string]ResolverEntry{
+		dns.TypeA:     {},
+		dns.TypeAAAA:  {},
+		dns.TypeCNAME: {},
+		//dns.TypeNS: {},
+		//dns.TypePTR: {},
+		dns.TypeSOA: {},
+		dns.TypeSRV: {},
+		dns.TypeTXT: {},
+	}}
+	for _, forward := range definition.Forward {
+		pool, err := upstream.NewPool(forward.Parent)
+		if err != nil {
+			log.Fatalf("Forwarding %s: %s", forward.Domain, err)
+		}
+		view.Forwarders = append(view.Forwarders, Forwarder{Domain: forward.Domain, Upstreams: pool})
+		view.pools = append(view.pools, pool)
+	}
+	// Longest domains first, so that the first match is the most specific one.
+	sort.SliceStable(view.Forwarders, func(i, j int) bool {
+		return len(view.Forwarders[i].Domain) > len(view.Forwarders[j].Domain)
+	})
+	return view
+}
+
+func (view *View) Name() string {
+	return view.Definition.Name
+}
+
+// Close releases the view's forwarders.
+func (view *View) Close() {
+	for _, pool := range view.pools {
+		pool.Close()
+	}
+}
+
+// matches tells whether the client behind req sees this view.
+func (view *View) matches(req *Request) bool {
+	if len(view.Definition.Listener) > 0 {
+		if req.Listener == nil {
+			return false
+		}
+		found := false
+		for _, name := range view.Definition.Listener {
+			if name == req.Listener.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return len(view.Definition.Match) == 0 || req.matchACL(view.Definition.Match)
+}
+
+// selectView returns the first view the client sees, if any.
+func (app *App) selectView(req *Request) *View {
+	for _, view := range app.Views {
+		if view.matches(req) {
+			return view
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const viewsConfig = `
+[[listener]]
+address = "127.0.0.1:5301"
+name = "internal"
+
+[[listener]]
+address = "127.0.0.1:5302"
+name = "public"
+
+[[view]]
+name = "signed"
+match = ["office.key."]
+
+[[view]]
+name = "office"
+match = ["10.1.0.0/16"]
+    [[view.zone]]
+    origin = "example.com."
+    TTL = 60
+        [view.zone.auth]
+        ns = "dns1.example.com"
+        email = "chris.example.com"
+        serial = 1
+        [[view.zone.record]]
+        host = "www"
+        ipv4 = "10.1.0.80"
+    [[view.forward]]
+    domain = "corp.internal."
+    address = "127.0.0.1:5311"
+
+[[view]]
+name = "internal"
+listener = ["internal"]
+match = ["10.0.0.0/8"]
+    [[view.forward]]
+    domain = "corp.internal."
+    address = "127.0.0.1:5312"
+
+[[view]]
+name = "public"
+listener = ["public"]
+
+[[zone]]
+origin = "example.com."
+TTL = 60
+    [zone.auth]
+    ns = "dns1.example.com"
+    email = "chris.example.com"
+    serial = 1
+    [[zone.record]]
+    host = "www"
+    ipv4 = "192.0.2.80"
+`
+
+// askView sends a query through a listener, "" for none, and returns the
+// response.
+func askView(app *App, listener string, client string, r *dns.Msg) *dns.Msg {
+	ctx := context.Background()
+	for idx := range app.Config.Listener {
+		if app.Config.Listener[idx].Name == listener {
+			ctx = context.WithValue(ctx, "listener", &app.Config.Listener[idx])
+		}
+	}
+	return ask(app, ctx, newTestWriter("udp"), client, r)
+}
+
+func TestSelectView(t *testing.T) {
+	app := newTestApp(t, viewsConfig, &testRecursor{address: "192.0.2.10"})
+	for _, test := range []struct {
+		listener string
+		client   string
+		key      string
+		expected string
+	}{
+		// The first matching view wins, whichever listener it came through.
+		{"internal", "10.1.2.3", "", "office"},
+		{"public", "10.1.2.3", "", "office"},
+		{"internal", "10.2.3.4", "", "internal"},
+		{"public", "172.16.0.1", "", "public"},
+		{"public", "10.2.3.4", "", "public"},
+		{"public", "192.0.2.1", "", "public"},
+		// A signed query sees its key's view, wherever it comes from.
+		{"public", "10.1.2.3", "office.key.", "signed"},
+		// Views only serve their own listeners and networks.
+		{"internal", "192.0.2.1", "", ""},
+		{"", "10.2.3.4", "", ""},
+	} {
+		req := &Request{RemoteIP: test.client, TsigKey: test.key}
+		for idx := range app.Config.Listener {
+			if app.Config.Listener[idx].Name == test.listener {
+				req.Listener = &app.Config.Listener[idx]
+			}
+		}
+		name := ""
+		if view := app.selectView(req); view != nil {
+			name = view.Name()
+		}
+		if name != test.expected {
+			t.Errorf("Through '%s', from %s, %s: expected view '%s', got '%s'", test.listener, test.client, test.key, test.expected, name)
+		}
+	}
+}
+
+func TestNoView(t *testing.T) {
+	recursor := &testRecursor{address: "192.0.2.10"}
+	app := newTestApp(t, viewsConfig, recursor)
+	r := query("www.example.com.", dns.TypeA)
+	r.SetEdns0(1232, false)
+	response := askView(app, "internal", "192.0.2.1:5353", r)
+	if response.Rcode != dns.RcodeRefused || len(response.Answer) != 0 {
+		t.Errorf("Expected the query to be refused, got %s", dns.RcodeToString[response.Rcode])
+	}
+	if errors := extendedErrors(response); len(errors) != 1 || errors[0].InfoCode != dns.ExtendedErrorCodeProhibited {
+		t.Errorf("Expected the refusal to be explained, got %v", errors)
+	}
+	if recursor.calls != 0 {
+		t.Error("Expected nothing to be looked up")
+	}
+}
+
+func TestViewZones(t *testing.T) {
+	app := newTestApp(t, viewsConfig, &testRecursor{address: "192.0.2.10"})
+	for _, test := range []struct {
+		listener string
+		client   string
+		key      string
+		expected string
+	}{
+		{"", "10.1.2.3:5353", "", "10.1.0.80"},
+		{"public", "192.0.2.1:5353", "", "192.0.2.80"},
+		{"internal", "10.2.3.4:5353", "office.key.", "192.0.2.80"},
+	} {
+		r := query("www.example.com.", dns.TypeA)
+		if test.key != "" {
+			r.SetTsig(test.key, dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		response := askView(app, test.listener, test.client, r)
+		if len(response.Answer) != 1 || response.Answer[0].(*dns.A).A.String() != test.expected {
+			t.Errorf("Through '%s', from %s, %s: expected %s, got %v", test.listener, test.client, test.key, test.expected, response.Answer)
+		}
+	}
+
+	// Views inheriting the same zones see each other's updates.
+	byName := map[string]*View{}
+	for _, view := range app.Views {
+		byName[view.Name()] = view
+	}
+	if byName["signed"].Records != byName["public"].Records || byName["office"].Records == byName["public"].Records {
+		t.Error("Expected only the views inheriting the top level zones to share their records")
+	}
+}
+
+func TestViewCache(t *testing.T) {
+	app := newTestApp(t, viewsConfig, &testRecursor{address: "192.0.2.10"})
+	office, internal := &testRecursor{address: "10.1.0.10"}, &testRecursor{address: "10.0.0.10"}
+	for _, view := range app.Views {
+		switch view.Name() {
+		case "office":
+			view.Forwarders[0].Upstreams = office
+		case "internal":
+			view.Forwarders[0].Upstreams = internal
+		}
+	}
+	for _, test := range []struct {
+		listener string
+		client   string
+		expected string
+	}{
+		{"", "10.1.2.3:5353", "10.1.0.10"},
+		{"internal", "10.2.3.4:5353", "10.0.0.10"},
+		{"", "10.1.2.3:5353", "10.1.0.10"},
+		{"internal", "10.2.3.4:5353", "10.0.0.10"},
+	} {
+		response := askView(app, test.listener, test.client, query("db.corp.internal.", dns.TypeA))
+		if len(response.Answer) != 1 || response.Answer[0].(*dns.A).A.String() != test.expected {
+			t.Errorf("Through '%s', from %s: expected %s, got %v", test.listener, test.client, test.expected, response.Answer)
+		}
+	}
+	if office.calls != 1 || internal.calls != 1 {
+		t.Errorf("Expected each view's answer to be cached for that view, got %d and %d lookups", office.calls, internal.calls)
+	}
+}